@@ -0,0 +1,373 @@
+package main
+
+import (
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	logr "github.com/sirupsen/logrus"
+)
+
+// Сжатые файлы и архивы тех журнала: rphost_1234/23101812.log.gz, .log.zst и архивы .zip с файлами
+// или каталогами процессов. Сжатые файлы читаются потоком, размер файла, позиции и смещения событий
+// считаются в байтах распакованного содержимого.
+
+// расширения сжатых файлов и архивов
+const (
+	extGzip = ".gz"
+	extZstd = ".zst"
+	extZip  = ".zip"
+)
+
+// compressedSize распакованный размер сжатого файла, пока не изменились размер и время изменения файла
+type compressedSize struct {
+	size    int64
+	modTime time.Time
+	// uncompressed размер распакованного содержимого
+	uncompressed int64
+}
+
+// compressedSizes распакованные размеры сжатых файлов по пути: чтобы узнать размер, файл распаковывается
+// целиком, а архивы тех журнала не меняются, и в режиме службы повторять это на каждом проходе не нужно.
+// compressedSeen пути сжатых файлов, найденных за проход: размеры остальных забываются closeZipArchives.
+var (
+	compressedSizes = make(map[string]compressedSize)
+	compressedSeen  = make(map[string]bool)
+)
+
+// zipArchive архив zip, открытый на время прохода: оглавление архива читается один раз,
+// а файлы архива открываются по имени из общего оглавления
+type zipArchive struct {
+	file *os.File
+	// list файлы в порядке оглавления, entries - по имени
+	list    []*zip.File
+	entries map[string]*zip.File
+	fileID  string
+	size    int64
+	modTime time.Time
+}
+
+// zipIdentity признаки файла архива, пока не изменились размер и время изменения архива
+type zipIdentity struct {
+	archive  string
+	size     int64
+	modTime  time.Time
+	identity fileIdentity
+}
+
+// zipArchives архивы, открытые за проход, по пути архива, закрываются closeZipArchives в конце прохода.
+// zipIdentities признаки файлов архивов по пути файла: для отпечатка файл архива распаковывается,
+// а архивы не меняются, и в режиме службы повторять это на каждом проходе не нужно.
+var (
+	zipArchives   = make(map[string]*zipArchive)
+	zipIdentities = make(map[string]zipIdentity)
+	zipArchivesMu sync.Mutex
+)
+
+// openZipArchive возвращает архив, открытый за текущий проход, открывая его при первом обращении
+func openZipArchive(name string) (*zipArchive, error) {
+
+	zipArchivesMu.Lock()
+	defer zipArchivesMu.Unlock()
+
+	if archive, ok := zipArchives[name]; ok {
+		return archive, nil
+	}
+
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	r, err := zip.NewReader(file, info.Size())
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	archive := &zipArchive{
+		file:    file,
+		list:    r.File,
+		entries: make(map[string]*zip.File, len(r.File)),
+		fileID:  getFileID(file),
+		size:    info.Size(),
+		modTime: info.ModTime(),
+	}
+	for _, entry := range r.File {
+		archive.entries[entry.Name] = entry
+	}
+	zipArchives[name] = archive
+	return archive, nil
+}
+
+// closeZipArchives закрывает архивы, открытые за проход. Признаки файлов архивов, которые
+// за проход не открывались (архив удален), и размеры сжатых файлов, не найденных за проход, забываются.
+func closeZipArchives() {
+
+	zipArchivesMu.Lock()
+	defer zipArchivesMu.Unlock()
+
+	for path, cached := range zipIdentities {
+		if _, ok := zipArchives[cached.archive]; !ok {
+			delete(zipIdentities, path)
+		}
+	}
+	for path := range compressedSizes {
+		if !compressedSeen[path] {
+			delete(compressedSizes, path)
+		}
+	}
+	compressedSeen = make(map[string]bool)
+	for name, archive := range zipArchives {
+		archive.file.Close()
+		delete(zipArchives, name)
+	}
+}
+
+// getZipFileIdentity признаки файла архива: идентификатор архива на диске и первые байты файла
+func getZipFileIdentity(file files) (fileIdentity, error) {
+
+	archive, err := openZipArchive(file.Archive)
+	if err != nil {
+		return fileIdentity{}, err
+	}
+
+	zipArchivesMu.Lock()
+	cached, ok := zipIdentities[file.Path]
+	zipArchivesMu.Unlock()
+	if ok && cached.size == archive.size && cached.modTime.Equal(archive.modTime) {
+		return cached.identity, nil
+	}
+
+	r, err := openTechLogFile(file, 0)
+	if err != nil {
+		return fileIdentity{}, err
+	}
+	defer r.Close()
+
+	identity := fileIdentity{FileID: archive.fileID}
+	if identity.prefix, err = readFingerprintPrefix(r); err != nil {
+		return identity, err
+	}
+
+	zipArchivesMu.Lock()
+	zipIdentities[file.Path] = zipIdentity{
+		archive:  file.Archive,
+		size:     archive.size,
+		modTime:  archive.modTime,
+		identity: identity,
+	}
+	zipArchivesMu.Unlock()
+	return identity, nil
+}
+
+// getTechLogFiles файлы каталога тех журнала: обычные и сжатые файлы и файлы внутри архивов zip.
+// Путь файла архива - путь архива и путь внутри архива: logs/2023.zip/rphost_1234/23101812.log
+func getTechLogFiles(root string) ([]files, error) {
+
+	arr, err := getFilesArray(root)
+
+	var result []files
+	for _, file := range arr {
+		switch strings.ToLower(filepath.Ext(file.Path)) {
+		case extZip:
+			entries, errZip := getZipFiles(file)
+			if errZip != nil {
+				logr.WithFields(logr.Fields{
+					"object": "File tech journal",
+					"title":  "Failure to read archive",
+				}).Warningf("%s: %v", file.Path, errZip)
+				continue
+			}
+			result = append(result, entries...)
+		case extGzip, extZstd:
+			size, errSize := getUncompressedSize(file)
+			if errSize != nil {
+				logr.WithFields(logr.Fields{
+					"object": "File tech journal",
+					"title":  "Failure to read compressed file",
+				}).Warningf("%s: %v", file.Path, errSize)
+				continue
+			}
+			file.Size = size
+			result = append(result, file)
+		default:
+			result = append(result, file)
+		}
+	}
+	return result, err
+}
+
+// getZipFiles файлы архива zip, каталоги архива пропускаются
+func getZipFiles(archive files) ([]files, error) {
+
+	zr, err := openZipArchive(archive.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []files
+	for _, entry := range zr.list {
+		if entry.FileInfo().IsDir() {
+			continue
+		}
+		// путь внутри архива не должен выходить за каталог архива
+		name := path.Clean("/" + entry.Name)[1:]
+		if name == "" {
+			continue
+		}
+		result = append(result, files{
+			Path:       filepath.Join(archive.Path, filepath.FromSlash(name)),
+			Size:       int64(entry.UncompressedSize64),
+			DataCreate: archive.DataCreate,
+			Archive:    archive.Path,
+			Entry:      entry.Name,
+		})
+	}
+	return result, nil
+}
+
+// getUncompressedSize размер распакованного содержимого файла .gz или .zst
+func getUncompressedSize(file files) (int64, error) {
+
+	compressedSeen[file.Path] = true
+	if cached, ok := compressedSizes[file.Path]; ok &&
+		cached.size == file.Size && cached.modTime.Equal(file.DataCreate) {
+		return cached.uncompressed, nil
+	}
+
+	r, err := openTechLogFile(file, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	size, err := io.Copy(ioutil.Discard, r)
+	if err != nil {
+		return 0, err
+	}
+	compressedSizes[file.Path] = compressedSize{size: file.Size, modTime: file.DataCreate, uncompressed: size}
+	return size, nil
+}
+
+// openTechLogFile открывает файл тех журнала для чтения с позиции position распакованного содержимого.
+// Обычный файл читается с позиции, сжатый файл и файл архива распаковываются с начала до позиции.
+func openTechLogFile(file files, position int64) (io.ReadCloser, error) {
+
+	if file.Archive == "" && !isCompressedFile(file.Path) {
+		openFile, err := os.Open(file.Path)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := openFile.Seek(position, io.SeekStart); err != nil {
+			openFile.Close()
+			return nil, err
+		}
+		return openFile, nil
+	}
+
+	r, err := openCompressedFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if position > 0 {
+		if _, err := io.CopyN(ioutil.Discard, r, position); err != nil {
+			r.Close()
+			if err == io.EOF {
+				err = fmt.Errorf("position %d is beyond the end of %s", position, file.Path)
+			}
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// openCompressedFile открывает распакованное содержимое файла архива zip или сжатого файла
+func openCompressedFile(file files) (io.ReadCloser, error) {
+
+	if file.Archive != "" {
+		archive, err := openZipArchive(file.Archive)
+		if err != nil {
+			return nil, err
+		}
+		entry, ok := archive.entries[file.Entry]
+		if !ok {
+			return nil, fmt.Errorf("%s: file %s not found in archive", file.Archive, file.Entry)
+		}
+		return entry.Open()
+	}
+
+	openFile, err := os.Open(file.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(filepath.Ext(file.Path)) {
+	case extGzip:
+		gr, err := gzip.NewReader(openFile)
+		if err != nil {
+			openFile.Close()
+			return nil, err
+		}
+		return &archiveReader{Reader: gr, closers: []io.Closer{gr, openFile}}, nil
+	case extZstd:
+		zr, err := zstd.NewReader(openFile, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			openFile.Close()
+			return nil, err
+		}
+		rc := zr.IOReadCloser()
+		return &archiveReader{Reader: rc, closers: []io.Closer{rc, openFile}}, nil
+	}
+	return openFile, nil
+}
+
+// statTechLogFile проверяет наличие файла тех журнала на диске, для файла архива проверяется архив
+func statTechLogFile(name string) error {
+	for dir := filepath.Dir(name); dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		if strings.ToLower(filepath.Ext(dir)) != extZip {
+			continue
+		}
+		if info, err := os.Stat(dir); err == nil && !info.IsDir() {
+			name = dir
+			break
+		}
+	}
+	_, err := os.Stat(name)
+	return err
+}
+
+// isCompressedFile файл .gz или .zst
+func isCompressedFile(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	return ext == extGzip || ext == extZstd
+}
+
+// archiveReader распакованное содержимое, при закрытии закрываются распаковщик и файл
+type archiveReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r *archiveReader) Close() error {
+	var result error
+	for _, c := range r.closers {
+		if err := c.Close(); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestZipArchiveOpenedOncePerPass(t *testing.T) {
+
+	dir := t.TempDir()
+	archivePath := filepath.Join(dir, "2024.zip")
+	writeTestZip(t, archivePath, 3, "first")
+	defer closeZipArchives()
+
+	arr, err := getTechLogFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(arr) != 3 || arr[0].Entry != "rphost_1/24010203.log" || arr[2].Entry != "rphost_3/24010203.log" {
+		t.Fatalf("files %+v", arr)
+	}
+
+	archive := zipArchives[archivePath]
+	var identities []fileIdentity
+	for _, file := range arr {
+		identity, err := getFileIdentity(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		identities = append(identities, identity)
+
+		r, err := openTechLogFile(file, 6)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(r)
+		r.Close()
+		if want := fmt.Sprintf("%s\n", file.Entry[7:8]); string(data) != want {
+			t.Errorf("%s from 6: %q, want %q", file.Entry, data, want)
+		}
+	}
+	// оглавление архива прочитано один раз за проход
+	if len(zipArchives) != 1 || zipArchives[archivePath] != archive {
+		t.Fatalf("archive reopened during the pass")
+	}
+	if string(identities[1].prefix) != "first 2\n" {
+		t.Errorf("prefix %q", identities[1].prefix)
+	}
+
+	// на следующем проходе признаки неизменного архива берутся из кэша
+	closeZipArchives()
+	zipIdentities[arr[0].Path] = zipIdentity{
+		archive:  archivePath,
+		size:     archive.size,
+		modTime:  archive.modTime,
+		identity: fileIdentity{FileID: "cached"},
+	}
+	if identity, _ := getFileIdentity(arr[0]); identity.FileID != "cached" {
+		t.Errorf("identity of unchanged archive is not cached: %+v", identity)
+	}
+
+	// архив изменился - признаки читаются заново
+	closeZipArchives()
+	writeTestZip(t, archivePath, 3, "second")
+	os.Chtimes(archivePath, time.Now(), time.Now().Add(time.Hour))
+	if identity, _ := getFileIdentity(arr[0]); string(identity.prefix) != "second 1\n" {
+		t.Errorf("identity of changed archive: %+v", identity)
+	}
+
+	// архив удален - признаки его файлов забываются
+	closeZipArchives()
+	os.Remove(archivePath)
+	closeZipArchives()
+	if len(zipIdentities) != 0 {
+		t.Errorf("%d identities of removed archive", len(zipIdentities))
+	}
+}
+
+func TestCompressedFiles(t *testing.T) {
+
+	dir := t.TempDir()
+	content := "first line\nsecond line\n"
+
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write([]byte(content))
+	gw.Close()
+	if err := ioutil.WriteFile(filepath.Join(dir, "24010203.log.gz"), gz.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	zw, _ := zstd.NewWriter(nil)
+	if err := ioutil.WriteFile(filepath.Join(dir, "24010204.log.zst"), zw.EncodeAll([]byte(content), nil), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer closeZipArchives()
+
+	arr, err := getTechLogFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(arr) != 2 {
+		t.Fatalf("files %+v", arr)
+	}
+	for _, file := range arr {
+		if file.Size != int64(len(content)) {
+			t.Errorf("%s: size %d, want %d", file.Path, file.Size, len(content))
+		}
+		r, err := openTechLogFile(file, 11)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(r)
+		r.Close()
+		if string(data) != "second line\n" {
+			t.Errorf("%s from 11: %q", file.Path, data)
+		}
+		if _, err := openTechLogFile(file, 100); err == nil {
+			t.Errorf("%s: position beyond the end is accepted", file.Path)
+		}
+	}
+
+	// на следующем проходе размер неизменного файла берется из кэша
+	closeZipArchives()
+	cached := compressedSizes[arr[0].Path]
+	cached.uncompressed = 1
+	compressedSizes[arr[0].Path] = cached
+	if again, _ := getTechLogFiles(dir); len(again) != 2 || again[0].Size != 1 {
+		t.Errorf("size of unchanged file is not cached: %+v", again)
+	}
+
+	// удаленный файл не найден за проход - его размер забывается
+	closeZipArchives()
+	os.Remove(arr[1].Path)
+	if _, err := getTechLogFiles(dir); err != nil {
+		t.Fatal(err)
+	}
+	closeZipArchives()
+	if _, ok := compressedSizes[arr[1].Path]; ok || len(compressedSizes) != 1 {
+		t.Errorf("sizes after removal: %v", compressedSizes)
+	}
+}
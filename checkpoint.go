@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// количество первых байт файла, по которым снимается отпечаток
+const fingerprintSize = 1024
+
+// checkpoint позиция прочитанного файла вместе с признаками, по которым файл можно опознать.
+// 1С может очистить каталог тех журнала и создать файл с тем же именем заново (тот же час),
+// тогда сохраненная позиция относится к другому файлу и чтение нужно начинать с начала.
+type checkpoint struct {
+	Position int64 `json:"pos"`
+	// FileID идентификатор файла в файловой системе (inode, индекс файла NTFS)
+	FileID string `json:"id,omitempty"`
+	// Fingerprint md5 первых FingerprintLen байт файла
+	Fingerprint    string `json:"fp,omitempty"`
+	FingerprintLen int64  `json:"fp_len,omitempty"`
+	// Hour состояние разбора файла за повторяющийся час перехода на зимнее время
+	Hour *hourState `json:"hour,omitempty"`
+	// Sent позиция, до которой события уже отправлены. Больше Position, если позиция удержана
+	// на событиях, ожидающих своего вызова CALL
+	Sent int64 `json:"sent,omitempty"`
+	// Outputs позиции, до которых события приняты приемниками, если они больше Sent: позиция удержана
+	// из-за ошибки другого приемника
+	Outputs map[string]int64 `json:"outputs,omitempty"`
+}
+
+// setSent сохраняет позиции, до которых события приняты приемниками: общая позиция Sent - наименьшая
+// из них, в Outputs - позиции приемников, которые ушли дальше
+func (cp *checkpoint) setSent(outputs map[string]int64) {
+
+	cp.Sent = 0
+	cp.Outputs = nil
+	first := true
+	for _, sent := range outputs {
+		if first || sent < cp.Sent {
+			cp.Sent = sent
+		}
+		first = false
+	}
+	if cp.Sent <= cp.Position {
+		cp.Sent = 0
+	}
+	for name, sent := range outputs {
+		if sent > maxInt64(cp.Sent, cp.Position) {
+			if cp.Outputs == nil {
+				cp.Outputs = make(map[string]int64)
+			}
+			cp.Outputs[name] = sent
+		}
+	}
+}
+
+// parseCheckpoint разбирает сохраненную позицию. Предыдущие версии парсера хранили только число - позицию.
+func parseCheckpoint(data []byte) (checkpoint, bool) {
+
+	var cp checkpoint
+	if pos, err := strconv.ParseInt(string(data), 10, 64); err == nil {
+		cp.Position = pos
+		return cp, true
+	}
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return cp, false
+	}
+	return cp, true
+}
+
+// fileIdentity признаки файла на момент сканирования каталога
+type fileIdentity struct {
+	FileID string
+	// prefix первые байты файла, не более fingerprintSize
+	prefix []byte
+}
+
+// getFileIdentity признаки файла: для сжатого файла и файла архива идентификатор файла на диске (архива)
+// и первые байты распакованного содержимого
+func getFileIdentity(file files) (fileIdentity, error) {
+
+	if file.Archive != "" {
+		return getZipFileIdentity(file)
+	}
+
+	var identity fileIdentity
+
+	diskFile, err := os.Open(file.Path)
+	if err != nil {
+		return identity, err
+	}
+	identity.FileID = getFileID(diskFile)
+	diskFile.Close()
+
+	openFile, err := openTechLogFile(file, 0)
+	if err != nil {
+		return identity, err
+	}
+	defer openFile.Close()
+
+	identity.prefix, err = readFingerprintPrefix(openFile)
+	return identity, err
+}
+
+// readFingerprintPrefix первые байты файла для отпечатка, не более fingerprintSize
+func readFingerprintPrefix(r io.Reader) ([]byte, error) {
+
+	buffer := make([]byte, fingerprintSize)
+	n, err := io.ReadFull(r, buffer)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	return buffer[:n], nil
+}
+
+func getFingerprint(data []byte) string {
+	hash := md5.Sum(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// newCheckpoint позиция для сохранения после чтения файла
+func (identity fileIdentity) newCheckpoint(pos int64) checkpoint {
+	return checkpoint{
+		Position:       pos,
+		FileID:         identity.FileID,
+		Fingerprint:    getFingerprint(identity.prefix),
+		FingerprintLen: int64(len(identity.prefix)),
+	}
+}
+
+// resolvePosition возвращает позицию, с которой нужно продолжить чтение файла,
+// и причину, если файл был усечен или заменен и читать его нужно с начала
+func (cp checkpoint) resolvePosition(identity fileIdentity, size int64) (int64, string) {
+
+	if cp.Position == 0 && cp.Sent == 0 && len(cp.Outputs) == 0 {
+		return 0, ""
+	}
+	if size < cp.Position {
+		return 0, "truncated"
+	}
+	if cp.FileID != "" && identity.FileID != "" && cp.FileID != identity.FileID {
+		return 0, "replaced"
+	}
+	if cp.Fingerprint != "" {
+		if cp.FingerprintLen > int64(len(identity.prefix)) ||
+			getFingerprint(identity.prefix[:cp.FingerprintLen]) != cp.Fingerprint {
+			return 0, "replaced"
+		}
+	}
+	return cp.Position, ""
+}
+
+// время жизни блокировки файла по умолчанию, в секундах
+const defaultLockTTL = 60
+
+// fileLock описание блокировки файла для вывода командой locks
+type fileLock struct {
+	Path  string
+	Owner string
+	// TTL оставшееся время жизни блокировки, отрицательное - блокировка без срока жизни
+	TTL time.Duration
+	// Legacy блокировка предыдущих версий парсера: ключ job_<путь> вне пространства имен
+	Legacy bool
+}
+
+// stale блокировка никогда не снимется сама: блокировка предыдущих версий парсера
+// или блокировка без срока жизни, например после ручного PERSIST
+func (l fileLock) stale() bool {
+	return l.Legacy || l.TTL < 0
+}
+
+// checkpointStore хранит последние прочитанные позиции файлов тех журнала
+// и блокировки файлов, которые обрабатываются в текущий момент.
+// Реализации должны быть безопасны для использования из нескольких горутин.
+type checkpointStore interface {
+	// getCheckpoint возвращает последнюю прочитанную позицию файла, нулевую - если файл еще не читался
+	getCheckpoint(path string) checkpoint
+	// setCheckpoint сохраняет прочитанную позицию файла
+	setCheckpoint(path string, cp checkpoint)
+	// lockFile ставит блокировку на файл от имени текущего инстанса, false - файл уже обрабатывается
+	lockFile(path string) bool
+	// unlockFile снимает блокировку с файла, если она принадлежит текущему инстансу
+	unlockFile(path string)
+	// refreshLocks продлевает все блокировки, взятые текущим инстансом
+	refreshLocks()
+	// lockLost блокировка файла, взятая текущим инстансом, истекла или снята командой locks break:
+	// файл может обрабатывать другой инстанс, и обработку нужно прервать без сохранения позиции
+	lockLost(path string) bool
+	// listLocks возвращает все существующие блокировки
+	listLocks() ([]fileLock, error)
+	// breakLock принудительно снимает блокировку файла, независимо от владельца
+	breakLock(path string) error
+	// deleteUnused удаляет позиции и блокировки файлов, которых больше нет
+	deleteUnused()
+	close() error
+}
+
+// openCheckpointStore открывает хранилище позиций, заданное параметром checkpoint_store
+func openCheckpointStore(config *conf) (checkpointStore, error) {
+	switch config.CheckpointStore {
+	case "", "redis":
+		return newRedisStore(config)
+	case "file":
+		return newFileStore(config.CheckpointFile)
+	default:
+		return nil, fmt.Errorf("unknown checkpoint store %q", config.CheckpointStore)
+	}
+}
+
+// getInstanceID идентификатор инстанса парсера - владельца блокировок
+func getInstanceID(config *conf) string {
+	if config.InstanceID != "" {
+		return config.InstanceID
+	}
+	host, _ := os.Hostname()
+	return host + "_" + strconv.Itoa(os.Getpid())
+}
+
+func getLockTTL(config *conf) time.Duration {
+	if config.LockTTL <= 0 {
+		return time.Second * defaultLockTTL
+	}
+	return time.Second * time.Duration(config.LockTTL)
+}
+
+// startLocksHeartbeat продлевает блокировки текущего инстанса, пока не будет закрыт канал done
+func startLocksHeartbeat(config *conf, store checkpointStore, done <-chan struct{}) {
+
+	ticker := time.NewTicker(getLockTTL(config) / 3)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				store.refreshLocks()
+			}
+		}
+	}()
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	logr "github.com/sirupsen/logrus"
+)
+
+// файл позиций по умолчанию, располагается рядом с исполняемым файлом
+const defaultCheckpointFile = "./techLog1C_checkpoints.json"
+
+// fileStore хранит позиции в локальном json файле, redis для него не нужен.
+// Блокировки действуют только в рамках одного процесса, поэтому запускать
+// несколько инстансов парсера с одним файлом позиций нельзя.
+type fileStore struct {
+	mu        sync.Mutex
+	path      string
+	positions map[string]checkpoint
+	locks     map[string]bool
+}
+
+func newFileStore(path string) (*fileStore, error) {
+
+	if path == "" {
+		path = defaultCheckpointFile
+	}
+
+	s := &fileStore{
+		path:      path,
+		positions: make(map[string]checkpoint),
+		locks:     make(map[string]bool),
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > 0 {
+		var raw map[string]json.RawMessage
+		if err = json.Unmarshal(data, &raw); err != nil {
+			return nil, err
+		}
+		for path, value := range raw {
+			if cp, ok := parseCheckpoint(value); ok {
+				s.positions[path] = cp
+			}
+		}
+	}
+	return s, nil
+}
+
+// save атомарно перезаписывает файл позиций: запись во временный файл и переименование.
+// Вызывается под блокировкой mu.
+func (s *fileStore) save() {
+
+	data, err := json.MarshalIndent(s.positions, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(s.path, data)
+	}
+	if err != nil {
+		logr.WithFields(logr.Fields{
+			"object": "Checkpoint store",
+			"title":  "Failure to save checkpoint file",
+		}).Error(err)
+	}
+}
+
+func writeFileAtomic(path string, data []byte) error {
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if errClose := tmp.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *fileStore) getCheckpoint(path string) checkpoint {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.positions[path]
+}
+
+func (s *fileStore) setCheckpoint(path string, cp checkpoint) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.positions[path] = cp
+	s.save()
+}
+
+func (s *fileStore) lockFile(path string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.locks[path] {
+		return false
+	}
+	s.locks[path] = true
+	return true
+}
+
+func (s *fileStore) unlockFile(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.locks, path)
+}
+
+// блокировки живут только в памяти процесса, продлевать их не нужно,
+// а после аварийного завершения процесса они не остаются
+func (s *fileStore) refreshLocks() {}
+
+// блокировку в памяти процесса может снять только сам процесс
+func (s *fileStore) lockLost(path string) bool { return false }
+
+func (s *fileStore) listLocks() ([]fileLock, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var locks []fileLock
+	for path := range s.locks {
+		locks = append(locks, fileLock{Path: path})
+	}
+	return locks, nil
+}
+
+func (s *fileStore) breakLock(path string) error {
+	s.unlockFile(path)
+	return nil
+}
+
+func (s *fileStore) deleteUnused() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	changed := false
+	for path := range s.positions {
+		if err := statTechLogFile(path); os.IsNotExist(err) {
+			delete(s.positions, path)
+			changed = true
+		}
+	}
+	if changed {
+		s.save()
+	}
+}
+
+func (s *fileStore) close() error {
+	return nil
+}
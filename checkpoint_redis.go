@@ -0,0 +1,412 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	logr "github.com/sirupsen/logrus"
+)
+
+// пространство имен ключей парсера по умолчанию
+const defaultRedisPrefix = "techlog1c:"
+
+// ключи внутри пространства имен: позиции файлов, блокировки файлов и признак того, что позиции
+// предыдущих версий парсера перенесены в пространство имен
+const (
+	redisPositionKey = "pos:"
+	redisLockKey     = "lock:"
+	redisMigratedKey = "migrated"
+)
+
+// блокировки предыдущих версий парсера: ключ job_<путь> без срока жизни вне пространства имен
+const redisLegacyLockKey = "job_"
+
+// снятие блокировки только владельцем
+var redisUnlockScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+// продление блокировки только владельцем
+var redisRefreshScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+
+// redisStore хранит позиции и блокировки в redis, что позволяет запускать несколько инстансов парсера.
+// Все ключи парсера лежат в пространстве имен redis_prefix: <prefix>pos:<путь> - позиция файла,
+// <prefix>lock:<путь> - блокировка со значением идентификатора инстанса и временем жизни lock_ttl,
+// которое продлевается, пока файл в обработке. Если инстанс аварийно завершился - блокировка снимется сама.
+type redisStore struct {
+	pool   *redis.Pool
+	prefix string
+	owner  string
+	ttl    time.Duration
+	// roots каталоги источников: позиции предыдущих версий ищутся только среди путей этих каталогов
+	roots []string
+
+	mu   sync.Mutex
+	held map[string]bool
+	// lost блокировки, которые не удалось продлить: их уже нет или они принадлежат другому инстансу
+	lost map[string]bool
+}
+
+func newRedisStore(config *conf) (*redisStore, error) {
+
+	pool := &redis.Pool{
+		MaxIdle: config.MaxDop + 1,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", config.RedisAddr,
+				redis.DialUsername(config.RedisLogin),
+				redis.DialPassword(config.RedisPassword),
+				redis.DialDatabase(config.RedisDatabase),
+			)
+		},
+	}
+
+	// проверим что redis доступен
+	conn := pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("PING"); err != nil {
+		pool.Close()
+		return nil, err
+	}
+
+	prefix := config.RedisPrefix
+	if prefix == "" {
+		prefix = defaultRedisPrefix
+	}
+
+	store := &redisStore{
+		pool:   pool,
+		prefix: prefix,
+		owner:  getInstanceID(config),
+		ttl:    getLockTTL(config),
+		held:   make(map[string]bool),
+		lost:   make(map[string]bool),
+	}
+	for _, source := range config.sources {
+		store.roots = append(store.roots, source.Path)
+	}
+	return store, nil
+}
+
+func getCheckpointRedis(conn redis.Conn, idFile string) (checkpoint, bool) {
+
+	valueRedis, err := redis.Bytes(conn.Do("GET", idFile))
+	if err != nil {
+		return checkpoint{}, false
+	}
+	return parseCheckpoint(valueRedis)
+}
+
+func setCheckpointRedis(conn redis.Conn, idFile string, cp checkpoint) {
+
+	data, _ := json.Marshal(cp)
+	conn.Do("SET", idFile, data)
+}
+
+// удаление ключа в redis
+func deleteFileParametersRedis(conn redis.Conn, idFile string) {
+	conn.Do("DEL", idFile)
+}
+
+// scanKeysRedis обходит ключи по шаблону командой SCAN, не блокируя redis как KEYS
+func scanKeysRedis(conn redis.Conn, pattern string, fn func(key string)) error {
+
+	cursor := 0
+	for {
+		values, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 1000))
+		if err != nil {
+			return err
+		}
+		cursor, _ = redis.Int(values[0], nil)
+		keys, _ := redis.Strings(values[1], nil)
+
+		for _, key := range keys {
+			fn(key)
+		}
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+func (s *redisStore) positionKey(path string) string {
+	return s.prefix + redisPositionKey + path
+}
+
+func (s *redisStore) lockKey(path string) string {
+	return s.prefix + redisLockKey + path
+}
+
+func (s *redisStore) getCheckpoint(path string) checkpoint {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	if cp, ok := getCheckpointRedis(conn, s.positionKey(path)); ok {
+		return cp
+	}
+
+	// позиция, записанная предыдущими версиями парсера под ключом-путем, переносится в пространство имен
+	cp, ok := getCheckpointRedis(conn, path)
+	if ok {
+		setCheckpointRedis(conn, s.positionKey(path), cp)
+		deleteFileParametersRedis(conn, path)
+	}
+	return cp
+}
+
+func (s *redisStore) setCheckpoint(path string, cp checkpoint) {
+	conn := s.pool.Get()
+	defer conn.Close()
+	setCheckpointRedis(conn, s.positionKey(path), cp)
+}
+
+func (s *redisStore) lockFile(path string) bool {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	_, err := redis.String(conn.Do("SET", s.lockKey(path), s.owner, "NX", "PX", s.ttl.Milliseconds()))
+	if err != nil {
+		// redis.ErrNil - блокировку держит другой инстанс
+		return false
+	}
+
+	s.mu.Lock()
+	s.held[path] = true
+	delete(s.lost, path)
+	s.mu.Unlock()
+	return true
+}
+
+func (s *redisStore) unlockFile(path string) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	s.mu.Lock()
+	delete(s.held, path)
+	delete(s.lost, path)
+	s.mu.Unlock()
+
+	redisUnlockScript.Do(conn, s.lockKey(path), s.owner)
+}
+
+func (s *redisStore) refreshLocks() {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for path := range s.held {
+		ok, err := redis.Int(redisRefreshScript.Do(conn, s.lockKey(path), s.owner, s.ttl.Milliseconds()))
+		if err != nil {
+			// redis недоступен - блокировка может быть еще жива, попробуем продлить ее в следующий раз
+			logr.WithFields(logr.Fields{
+				"object": "Redis",
+				"title":  "Failure to refresh lock",
+				"file":   path,
+			}).Warning(err)
+			continue
+		}
+		if ok == 0 {
+			// блокировка истекла или снята, файл мог взять другой инстанс - задание прервет обработку файла
+			logr.WithFields(logr.Fields{
+				"object": "Redis",
+				"title":  "Lock lost",
+				"file":   path,
+			}).Warning("The file lock has expired or was broken, processing of the file is cancelled")
+			delete(s.held, path)
+			s.lost[path] = true
+		}
+	}
+}
+
+func (s *redisStore) lockLost(path string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lost[path]
+}
+
+func (s *redisStore) listLocks() ([]fileLock, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	var keys []string
+	err := scanKeysRedis(conn, s.lockKey("*"), func(key string) {
+		keys = append(keys, key)
+	})
+	if err != nil {
+		return nil, err
+	}
+	var legacyKeys []string
+	err = scanKeysRedis(conn, redisLegacyLockKey+"*", func(key string) {
+		legacyKeys = append(legacyKeys, key)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var locks []fileLock
+	for _, key := range keys {
+		if lock, ok := getLockRedis(conn, key, strings.TrimPrefix(key, s.lockKey(""))); ok {
+			locks = append(locks, lock)
+		}
+	}
+	for _, key := range legacyKeys {
+		if lock, ok := getLockRedis(conn, key, strings.TrimPrefix(key, redisLegacyLockKey)); ok {
+			lock.Legacy = true
+			locks = append(locks, lock)
+		}
+	}
+	return locks, nil
+}
+
+// getLockRedis владелец и оставшееся время жизни блокировки, false - блокировка уже снята
+func getLockRedis(conn redis.Conn, key string, path string) (fileLock, bool) {
+
+	owner, err := redis.String(conn.Do("GET", key))
+	if err != nil {
+		return fileLock{}, false
+	}
+	ttl, err := redis.Int64(conn.Do("PTTL", key))
+	if err != nil || ttl == -2 {
+		return fileLock{}, false
+	}
+	return fileLock{
+		Path:  path,
+		Owner: owner,
+		TTL:   time.Duration(ttl) * time.Millisecond,
+	}, true
+}
+
+// breakLock снимает блокировку файла и блокировку предыдущих версий парсера job_<путь>
+func (s *redisStore) breakLock(path string) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("DEL", s.lockKey(path), redisLegacyLockKey+path)
+	return err
+}
+
+// удаление ключей парсера, файлы которых больше не существуют.
+// Обходится только собственное пространство имен, чужие ключи в общей базе не затрагиваются.
+// Перед первой очисткой переносятся позиции предыдущих версий парсера.
+func (s *redisStore) deleteUnused() {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	if err := s.migrateLegacyPositions(conn); err != nil {
+		logr.WithFields(logr.Fields{
+			"object": "Redis",
+			"title":  "Failure to migrate legacy positions",
+		}).Warning(err)
+	}
+
+	var keys []string
+	err := scanKeysRedis(conn, s.prefix+"*", func(key string) {
+		keys = append(keys, key)
+	})
+	if err != nil {
+		logr.WithFields(logr.Fields{
+			"object": "Redis",
+			"title":  "Failure to scan keys",
+		}).Warning(err)
+		return
+	}
+
+	for _, key := range keys {
+		var currKey string
+		switch {
+		case strings.HasPrefix(key, s.positionKey("")):
+			currKey = strings.TrimPrefix(key, s.positionKey(""))
+		case strings.HasPrefix(key, s.lockKey("")):
+			currKey = strings.TrimPrefix(key, s.lockKey(""))
+		default:
+			continue
+		}
+		if err := statTechLogFile(currKey); err != nil {
+			if os.IsNotExist(err) {
+				// если файла больше нет - удалим запись из базы
+				deleteFileParametersRedis(conn, key)
+			} else {
+				logr.WithFields(logr.Fields{
+					"object": "File tech journal",
+				}).Warning(err)
+			}
+		}
+	}
+}
+
+// migrateLegacyPositions однократно переносит позиции предыдущих версий парсера - ключ-путь файла
+// вне пространства имен со значением-числом - в пространство имен, позиции удаленных файлов удаляются.
+// Ключом считаются только пути внутри каталогов источников, чужие ключи в общей базе не затрагиваются.
+// После переноса в пространстве имен ставится признак, и база больше не обходится.
+func (s *redisStore) migrateLegacyPositions(conn redis.Conn) error {
+
+	if len(s.roots) == 0 {
+		return nil
+	}
+	migrated, err := redis.Bool(conn.Do("EXISTS", s.prefix+redisMigratedKey))
+	if err != nil || migrated {
+		return err
+	}
+
+	var keys []string
+	err = scanKeysRedis(conn, "*", func(key string) {
+		if !strings.HasPrefix(key, s.prefix) && s.underRoot(key) {
+			keys = append(keys, key)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		value, err := redis.String(conn.Do("GET", key))
+		if err != nil {
+			continue
+		}
+		pos, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			continue
+		}
+		err = statTechLogFile(key)
+		if err != nil && !os.IsNotExist(err) {
+			continue
+		}
+		// позиция существующего файла переносится, если в пространстве имен позиции еще нет
+		if err == nil {
+			if _, ok := getCheckpointRedis(conn, s.positionKey(key)); !ok {
+				setCheckpointRedis(conn, s.positionKey(key), checkpoint{Position: pos})
+			}
+		}
+		deleteFileParametersRedis(conn, key)
+	}
+
+	_, err = conn.Do("SET", s.prefix+redisMigratedKey, 1)
+	return err
+}
+
+// underRoot путь внутри каталога одного из источников
+func (s *redisStore) underRoot(path string) bool {
+	for _, root := range s.roots {
+		root = strings.TrimRight(root, `/\`)
+		if strings.HasPrefix(path, root) && len(path) > len(root) && strings.ContainsRune(`/\`, rune(path[len(root)])) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *redisStore) close() error {
+	return s.pool.Close()
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// newTestRedisStore хранилище в redis по адресу из TECHLOG1C_TEST_REDIS, без адреса тест пропускается.
+// Ключи теста лежат в отдельном пространстве имен и удаляются после теста.
+func newTestRedisStore(t *testing.T, roots ...string) *redisStore {
+
+	addr := os.Getenv("TECHLOG1C_TEST_REDIS")
+	if addr == "" {
+		t.Skip("TECHLOG1C_TEST_REDIS is not set")
+	}
+	config := &conf{
+		RedisAddr:   addr,
+		RedisPrefix: fmt.Sprintf("techlog1c_test_%d:", time.Now().UnixNano()),
+		MaxDop:      1,
+	}
+	for _, root := range roots {
+		config.sources = append(config.sources, &logSource{sourceConf: sourceConf{Path: root}})
+	}
+	store, err := newRedisStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn := store.pool.Get()
+		scanKeysRedis(conn, store.prefix+"*", func(key string) { conn.Do("DEL", key) })
+		conn.Close()
+		store.close()
+	})
+	return store
+}
+
+func TestRedisMigrateLegacyPositions(t *testing.T) {
+
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "rphost_1", "24010203.log")
+	removed := filepath.Join(dir, "rphost_2", "24010203.log")
+	os.MkdirAll(filepath.Dir(existing), 0755)
+	ioutil.WriteFile(existing, []byte("data"), 0644)
+	outside := filepath.Join(filepath.Dir(dir), "other", "24010203.log")
+
+	store := newTestRedisStore(t, dir)
+	conn := store.pool.Get()
+	defer conn.Close()
+	defer conn.Do("DEL", existing, removed, outside)
+	for _, key := range []string{existing, removed, outside} {
+		conn.Do("SET", key, "100")
+	}
+
+	store.deleteUnused()
+
+	if cp := store.getCheckpoint(existing); cp.Position != 100 {
+		t.Errorf("position of existing file %d", cp.Position)
+	}
+	for _, key := range []string{existing, removed} {
+		if ok, _ := redis.Bool(conn.Do("EXISTS", key)); ok {
+			t.Errorf("legacy key %s is kept", key)
+		}
+	}
+	if ok, _ := redis.Bool(conn.Do("EXISTS", store.positionKey(removed))); ok {
+		t.Errorf("position of removed file is moved")
+	}
+	if ok, _ := redis.Bool(conn.Do("EXISTS", outside)); !ok {
+		t.Errorf("key outside of source directories is deleted")
+	}
+
+	// база обходится один раз: ключ, появившийся позже, не переносится
+	conn.Do("SET", removed, "100")
+	store.deleteUnused()
+	if ok, _ := redis.Bool(conn.Do("EXISTS", removed)); !ok {
+		t.Errorf("legacy keys are scanned again")
+	}
+}
+
+func TestRedisLocks(t *testing.T) {
+
+	first := newTestRedisStore(t)
+	second := &redisStore{pool: first.pool, prefix: first.prefix, owner: "second", ttl: first.ttl,
+		held: make(map[string]bool), lost: make(map[string]bool)}
+	conn := first.pool.Get()
+	defer conn.Close()
+	path := "logs/rphost_1/24010203.log"
+
+	if !first.lockFile(path) || second.lockFile(path) {
+		t.Fatalf("file is locked by two instances")
+	}
+	if ttl, _ := redis.Int64(conn.Do("PTTL", first.lockKey(path))); ttl <= 0 || ttl > first.ttl.Milliseconds() {
+		t.Errorf("lock ttl %d", ttl)
+	}
+
+	// чужую блокировку не снимает ни снятие, ни продление другим инстансом
+	second.unlockFile(path)
+	second.held[path] = true
+	second.refreshLocks()
+	if owner, _ := redis.String(conn.Do("GET", first.lockKey(path))); owner != first.owner || !second.lockLost(path) {
+		t.Errorf("lock owner %q, lost by second %v", owner, second.lockLost(path))
+	}
+
+	// продление владельцем восстанавливает время жизни
+	conn.Do("PEXPIRE", first.lockKey(path), 1000)
+	first.refreshLocks()
+	if ttl, _ := redis.Int64(conn.Do("PTTL", first.lockKey(path))); ttl <= 1000 || first.lockLost(path) {
+		t.Errorf("lock ttl after refresh %d", ttl)
+	}
+
+	// блокировка истекла и взята другим инстансом - прежний владелец узнает о потере и не снимает ее
+	conn.Do("DEL", first.lockKey(path))
+	if !second.lockFile(path) {
+		t.Fatalf("expired lock is not taken")
+	}
+	first.refreshLocks()
+	if !first.lockLost(path) {
+		t.Errorf("lost lock is not detected")
+	}
+	first.unlockFile(path)
+	if owner, _ := redis.String(conn.Do("GET", first.lockKey(path))); owner != "second" {
+		t.Errorf("lock owner after unlock by previous owner %q", owner)
+	}
+
+	// блокировки предыдущих версий показываются устаревшими и снимаются вместе с блокировкой файла
+	legacy := redisLegacyLockKey + path
+	conn.Do("SET", legacy, "1")
+	defer conn.Do("DEL", legacy)
+	locks, err := second.listLocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found []string
+	for _, lock := range locks {
+		if lock.Path == path {
+			found = append(found, fmt.Sprintf("%s stale=%v", lock.Owner, lock.stale()))
+		}
+	}
+	if fmt.Sprint(found) != "[second stale=false 1 stale=true]" {
+		t.Errorf("locks %v", found)
+	}
+	if err := second.breakLock(path); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := redis.Int(conn.Do("EXISTS", second.lockKey(path), legacy)); n != 0 {
+		t.Errorf("%d locks after break", n)
+	}
+}
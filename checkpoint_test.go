@@ -0,0 +1,126 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolvePosition(t *testing.T) {
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "24010203.log")
+	write := func(content string) files {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return files{Path: path, Size: int64(len(content))}
+	}
+	resolve := func(cp checkpoint, file files) (int64, string) {
+		identity, err := getFileIdentity(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cp.resolvePosition(identity, file.Size)
+	}
+
+	first := "04:05.000001-10,CALL,1\n"
+	file := write(first)
+	identity, err := getFileIdentity(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp := identity.newCheckpoint(file.Size)
+
+	// файл дописан - чтение продолжается с позиции
+	file = write(first + "04:05.000002-20,CALL,1\n")
+	if pos, reason := resolve(cp, file); pos != int64(len(first)) || reason != "" {
+		t.Errorf("appended: %d, %q", pos, reason)
+	}
+
+	// файл усечен - чтение с начала
+	file = write("04:05")
+	if pos, reason := resolve(cp, file); pos != 0 || reason != "truncated" {
+		t.Errorf("truncated: %d, %q", pos, reason)
+	}
+
+	// файл перезаписан тем же inode с другим началом и большим размером
+	file = write(strings.Repeat("05:06.000001-30,CALL,1\n", 3))
+	if pos, reason := resolve(cp, file); pos != 0 || reason != "replaced" {
+		t.Errorf("rewritten: %d, %q", pos, reason)
+	}
+
+	// ротация: файл переименован, на его месте новый файл
+	file = write(first)
+	identity, _ = getFileIdentity(file)
+	cp = identity.newCheckpoint(file.Size)
+	if err := os.Rename(path, path+".old"); err != nil {
+		t.Fatal(err)
+	}
+	file = write(first + first)
+	if pos, reason := resolve(cp, file); pos != 0 || reason != "replaced" {
+		t.Errorf("rotated: %d, %q", pos, reason)
+	}
+
+	// позиция предыдущих версий - только число, без признаков файла
+	legacy, ok := parseCheckpoint([]byte("23"))
+	if !ok {
+		t.Fatal("legacy checkpoint is not parsed")
+	}
+	if pos, reason := resolve(legacy, file); pos != 23 || reason != "" {
+		t.Errorf("legacy: %d, %q", pos, reason)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "checkpoints.json")
+	logFile, gone := filepath.Join(dir, "a.log"), filepath.Join(dir, "gone.log")
+	ioutil.WriteFile(logFile, []byte("data"), 0644)
+	store, err := newFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !store.lockFile(logFile) || store.lockFile(logFile) {
+		t.Errorf("file is locked twice")
+	}
+	store.unlockFile(logFile)
+	if !store.lockFile(logFile) {
+		t.Errorf("file is not unlocked")
+	}
+
+	cp := checkpoint{Position: 100, FileID: "1:2", Sent: 120, Outputs: map[string]int64{"webhook_2": 150}}
+	store.setCheckpoint(logFile, cp)
+	store.setCheckpoint(gone, checkpoint{Position: 5})
+	if err := store.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// позиции переживают перезапуск, блокировки - нет
+	store, err = newFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !store.lockFile(logFile) {
+		t.Errorf("lock is kept after restart")
+	}
+	if got := store.getCheckpoint(logFile); got.Position != 100 || got.FileID != "1:2" || got.Sent != 120 || got.Outputs["webhook_2"] != 150 {
+		t.Errorf("checkpoint after restart %+v", got)
+	}
+	if got := store.getCheckpoint("missing.log"); got.Position != 0 {
+		t.Errorf("checkpoint of unknown file %+v", got)
+	}
+
+	// позиции удаленных файлов удаляются
+	store.deleteUnused()
+	if got := store.getCheckpoint(gone); got.Position != 0 {
+		t.Errorf("checkpoint of removed file %+v", got)
+	}
+	if got := store.getCheckpoint(logFile); got.Position != 100 {
+		t.Errorf("checkpoint of existing file %+v", got)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+)
+
+const commandsUsage = `Использование:
+  techLog1C                       обработка тех журнала (разовый проход или служба при daemon: true)
+  techLog1C locks list            список блокировок файлов
+  techLog1C locks break [-stale] [путь ...]
+                                  снятие блокировок: указанных файлов или всех устаревших
+                                  (job_* предыдущих версий и без срока жизни)
+  techLog1C deadletter replay     повторная отправка документов, отклоненных Elasticsearch (после исправления карт)
+  techLog1C convert -in каталог -out файл [-format ndjson|csv|parquet] [-split] [-pattern шаблон] [-tz пояс]
+                                  преобразование каталога тех журнала в файл без хранилища позиций и отправки
+`
+
+// runCommand выполняет служебную команду и возвращает код завершения процесса
+func runCommand(config *conf, args []string) int {
+
+	switch args[0] {
+	case "locks":
+		return commandLocks(config, args[1:])
+	case "deadletter":
+		return commandDeadLetter(config, args[1:])
+	case "convert":
+		return commandConvert(config, args[1:])
+	default:
+		fmt.Fprint(os.Stderr, commandsUsage)
+		return 2
+	}
+}
+
+func commandLocks(config *conf, args []string) int {
+
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, commandsUsage)
+		return 2
+	}
+
+	store, err := openCheckpointStore(config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer store.close()
+
+	switch args[0] {
+	case "list":
+		locks, err := store.listLocks()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "FILE\tOWNER\tTTL\tSTALE")
+		for _, lock := range locks {
+			ttl := "-"
+			if !lock.stale() {
+				ttl = lock.TTL.String()
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%v\n", lock.Path, lock.Owner, ttl, lock.stale())
+		}
+		w.Flush()
+
+	case "break":
+		flags := flag.NewFlagSet("locks break", flag.ContinueOnError)
+		stale := flags.Bool("stale", false, "снять блокировки предыдущих версий и блокировки без срока жизни")
+		if err := flags.Parse(args[1:]); err != nil {
+			return 2
+		}
+
+		paths := flags.Args()
+		if *stale {
+			locks, err := store.listLocks()
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+			for _, lock := range locks {
+				if lock.stale() {
+					paths = append(paths, lock.Path)
+				}
+			}
+		}
+
+		for _, path := range paths {
+			if err := store.breakLock(path); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+			fmt.Println("unlocked:", path)
+		}
+
+	default:
+		fmt.Fprint(os.Stderr, commandsUsage)
+		return 2
+	}
+
+	return 0
+}
+
+func commandDeadLetter(config *conf, args []string) int {
+
+	if len(args) == 0 || args[0] != "replay" {
+		fmt.Fprint(os.Stderr, commandsUsage)
+		return 2
+	}
+
+	// источники нужны для индексов документов, не принятых приемником целиком
+	if err := config.initSources(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := config.initOutputs(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := config.initDeadLetters(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer closeOutputs()
+
+	result, err := config.deadLetters.replay()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("replayed: %d, rejected: %d\n", result.Replayed, result.Rejected)
+	if result.Rejected > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"strings"
+)
+
+// splitContext разбивает контекст 1С на строки стека вызовов: первая строка - точка входа
+// (форма, команда), последняя - строка кода, которая выполнялась. Отступы и пустые строки отбрасываются.
+func splitContext(context string) []string {
+
+	var frames []string
+	for _, line := range strings.Split(context, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			frames = append(frames, line)
+		}
+	}
+	return frames
+}
+
+// addContextFrames добавляет к событию строки стека контекста context_frames, первую и последнюю строку
+// context_first, context_last и отпечаток стека context_hash. Если контекстов в событии несколько, берется первый.
+func addContextFrames(fields map[string]interface{}) {
+
+	var context string
+	if values := unquoteValues(fields["context"]); len(values) > 0 {
+		context = values[0]
+	}
+
+	frames := splitContext(context)
+	if len(frames) == 0 {
+		return
+	}
+
+	hash := md5.Sum([]byte(strings.Join(frames, "\n")))
+
+	fields["context_frames"] = frames
+	fields["context_first"] = frames[0]
+	fields["context_last"] = frames[len(frames)-1]
+	fields["context_hash"] = hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestAddContextFrames(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		context interface{}
+		want    string
+	}{
+		{"quoted stack with indents", "'Форма.Записать : 1 : Записать();\n\tОбщийМодуль.Проведение : 25 : Провести();\n\t\tДокумент.Модуль : 7 : Блокировка.Заблокировать();'",
+			"[Форма.Записать : 1 : Записать(); ОбщийМодуль.Проведение : 25 : Провести(); Документ.Модуль : 7 : Блокировка.Заблокировать();] " +
+				"Форма.Записать : 1 : Записать(); | Документ.Модуль : 7 : Блокировка.Заблокировать();"},
+		{"single line without quotes", "Справочник.Контрагенты.Форма : 3",
+			"[Справочник.Контрагенты.Форма : 3] Справочник.Контрагенты.Форма : 3 | Справочник.Контрагенты.Форма : 3"},
+		{"first of repeated contexts", []string{"'А : 1\n\tБ : 2'", "'В : 3'"},
+			"[А : 1 Б : 2] А : 1 | Б : 2"},
+		{"empty lines are dropped", "'\n\tА : 1\n\n\tБ : 2\n'",
+			"[А : 1 Б : 2] А : 1 | Б : 2"},
+		{"empty context", "''", "[] |"},
+		{"no context", nil, "[] |"},
+	}
+
+	hashes := make(map[string]string)
+	for _, tt := range tests {
+		fields := map[string]interface{}{}
+		if tt.context != nil {
+			fields["context"] = tt.context
+		}
+		addContextFrames(fields)
+		got := fmt.Sprintf("%v %v | %v", fields["context_frames"], fields["context_first"], fields["context_last"])
+		if fields["context_frames"] == nil {
+			got = "[] |"
+		}
+		if got != tt.want {
+			t.Errorf("%s:\n got %s\nwant %s", tt.name, got, tt.want)
+		}
+		if hash, ok := fields["context_hash"].(string); ok {
+			hashes[tt.name] = hash
+		}
+	}
+
+	// отпечаток зависит от строк стека, а не от отступов
+	if hashes["first of repeated contexts"] != hashes["empty lines are dropped"] || hashes["first of repeated contexts"] == "" {
+		t.Errorf("hashes %v", hashes)
+	}
+	if len(hashes) != 4 {
+		t.Errorf("%d hashes, want 4", len(hashes))
+	}
+}
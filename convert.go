@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// форматы результата команды convert
+const (
+	convertNDJSON  = "ndjson"
+	convertCSV     = "csv"
+	convertParquet = "parquet"
+)
+
+// commandConvert преобразует каталог тех журнала в файл NDJSON, CSV или Parquet без хранилища позиций
+// и без отправки по сети, например для разбора архива тех журнала, полученного от клиента.
+// Используются настройки разбора settings.yaml (time_zone, path_pattern, filters, processors и т.п.),
+// параметры подключения не нужны.
+func commandConvert(config *conf, args []string) int {
+
+	flags := flag.NewFlagSet("convert", flag.ContinueOnError)
+	in := flags.String("in", "", "каталог тех журнала")
+	out := flags.String("out", "", "файл результата, при -split - каталог")
+	format := flags.String("format", convertNDJSON, "формат результата: ndjson, csv, parquet")
+	split := flags.Bool("split", false, "отдельный файл для каждого типа событий")
+	pattern := flags.String("pattern", "", "шаблон пути файлов тех журнала, по умолчанию path_pattern")
+	timeZone := flags.String("tz", "", "часовой пояс тех журнала, по умолчанию time_zone")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *in == "" || *out == "" {
+		fmt.Fprint(os.Stderr, commandsUsage)
+		return 2
+	}
+	switch *format {
+	case convertNDJSON, convertCSV, convertParquet:
+	default:
+		fmt.Fprintf(os.Stderr, "unknown format %q\n", *format)
+		return 2
+	}
+
+	// единственный источник - каталог in
+	config.Path = *in
+	config.Sources = nil
+	if *pattern != "" {
+		config.PathPattern = *pattern
+	}
+	if *timeZone != "" {
+		config.TimeZone = *timeZone
+	}
+	if err := config.initSources(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := config.initCorrelation(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if config.AnalyzeLocks {
+		config.locks = newLockAnalyzer()
+	}
+
+	if *split {
+		if err := os.MkdirAll(*out, 0755); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+
+	w := newConvertWriter(*out, *format, *split)
+	err := convertTechLogs(config, w)
+	if errClose := w.close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "FILE\tEVENTS")
+	for _, output := range w.sortedOutputs() {
+		fmt.Fprintf(tw, "%s\t%d\n", output.path, output.count)
+	}
+	tw.Flush()
+	return 0
+}
+
+// convertTechLogs читает все файлы каталога тех журнала с начала и записывает события в w
+func convertTechLogs(config *conf, w *convertWriter) error {
+
+	source := config.sources[0]
+	defer closeZipArchives()
+	arr, err := getTechLogFiles(source.Path)
+	if err != nil {
+		return err
+	}
+	sort.Slice(arr, func(i, j int) bool { return arr[i].Path < arr[j].Path })
+
+	multiValued := getMultiValuedFields(getMappings())
+
+	for _, file := range arr {
+		info, ok := source.pathPattern.matchFile(source.Path, file)
+		if !ok {
+			fmt.Fprintln(os.Stderr, "file does not match path_pattern, skipped:", file.Path)
+			continue
+		}
+		file.Source = source
+		file.FileDate = info.FileDate
+		file.ProcessNameID = info.processNameID()
+		file.ProcessName = info.Process
+		file.ProcessID = info.PID
+
+		if err := convertFile(config, file, multiValued, w); err != nil {
+			return fmt.Errorf("%s: %v", file.Path, err)
+		}
+	}
+
+	// цепочки ожиданий блокировок по всем файлам каталога
+	if config.locks != nil {
+		for _, doc := range config.locks.flush() {
+			if err := w.write(doc.Event.Name, doc.Event.document()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// convertFile разбирает файл тех журнала так же, как jobExtractTechLogs: отбор, обработчики полей,
+// связь с вызовами и анализ блокировок. Файл считается дописанным, ожидающие вызова события
+// записываются без связи в конце файла.
+func convertFile(config *conf, file files, multiValued map[string]map[string]bool, w *convertWriter) error {
+
+	openFile, err := openTechLogFile(file, 0)
+	if err != nil {
+		return err
+	}
+	defer openFile.Close()
+
+	var failed error
+	pipeline := newFilePipeline(config, file, openFile, 0, multiValued, func(item *fileEvent, trigger int64) {
+		if failed == nil {
+			failed = w.write(item.event.Name, item.event.document())
+		}
+	})
+
+	for failed == nil {
+		ok, err := pipeline.next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+	}
+
+	pipeline.flush(0)
+	return failed
+}
+
+// convertWriter запись событий команды convert в один файл или в файл каждого типа событий.
+// NDJSON пишется сразу, для CSV и Parquet события сначала пишутся во временный файл,
+// по которому собираются колонки и их типы, а при закрытии формируется результат.
+type convertWriter struct {
+	out     string
+	format  string
+	split   bool
+	outputs map[string]*convertOutput
+}
+
+// convertOutput файл результата
+type convertOutput struct {
+	path  string
+	file  *os.File
+	w     *bufio.Writer
+	count int
+	// columns колонки CSV и Parquet по именам полей
+	columns map[string]*convertColumn
+}
+
+// convertColumn типы значений поля во всех событиях файла
+type convertColumn struct {
+	strings int
+	ints    int
+	others  int
+	// timestamps все строковые значения - время в формате @timestamp
+	timestamps bool
+}
+
+func newConvertWriter(out string, format string, split bool) *convertWriter {
+	return &convertWriter{
+		out:     out,
+		format:  format,
+		split:   split,
+		outputs: make(map[string]*convertOutput),
+	}
+}
+
+// write записывает документ события
+func (cw *convertWriter) write(event string, doc map[string]interface{}) error {
+
+	key := ""
+	if cw.split {
+		key = strings.ToLower(event)
+	}
+
+	output, ok := cw.outputs[key]
+	if !ok {
+		var err error
+		if output, err = cw.open(key); err != nil {
+			return err
+		}
+		cw.outputs[key] = output
+	}
+
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	output.w.Write(data)
+	if err := output.w.WriteByte('\n'); err != nil {
+		return err
+	}
+	output.count++
+
+	if output.columns != nil {
+		for name, value := range doc {
+			output.observe(name, value)
+		}
+	}
+	return nil
+}
+
+// open создает файл результата или, для CSV и Parquet, временный файл событий
+func (cw *convertWriter) open(key string) (*convertOutput, error) {
+
+	output := &convertOutput{path: cw.out}
+	if cw.split {
+		output.path = filepath.Join(cw.out, key+"."+cw.format)
+	}
+
+	var err error
+	if cw.format == convertNDJSON {
+		output.file, err = os.Create(output.path)
+	} else {
+		output.file, err = ioutil.TempFile("", "techLog1C_convert_*.ndjson")
+		output.columns = make(map[string]*convertColumn)
+	}
+	if err != nil {
+		return nil, err
+	}
+	output.w = bufio.NewWriter(output.file)
+	return output, nil
+}
+
+func (o *convertOutput) observe(name string, value interface{}) {
+
+	column := o.columns[name]
+	if column == nil {
+		column = &convertColumn{timestamps: true}
+		o.columns[name] = column
+	}
+
+	switch value := value.(type) {
+	case int64:
+		column.ints++
+	case string:
+		column.strings++
+		if column.timestamps {
+			if _, err := time.Parse(eventDateFormat, value); err != nil {
+				column.timestamps = false
+			}
+		}
+	default:
+		column.others++
+	}
+}
+
+// columnType тип колонки Parquet: целые - INT64, время - TIMESTAMP, остальное - строка
+func (c *convertColumn) columnType() int {
+	switch {
+	case c.others > 0:
+		return parquetString
+	case c.ints > 0 && c.strings == 0:
+		return parquetInt64
+	case c.strings > 0 && c.ints == 0 && c.timestamps:
+		return parquetTimestamp
+	}
+	return parquetString
+}
+
+// sortedOutputs файлы результата по пути
+func (cw *convertWriter) sortedOutputs() []*convertOutput {
+	var outputs []*convertOutput
+	for _, output := range cw.outputs {
+		outputs = append(outputs, output)
+	}
+	sort.Slice(outputs, func(i, j int) bool { return outputs[i].path < outputs[j].path })
+	return outputs
+}
+
+// close завершает запись всех файлов, для CSV и Parquet формирует результат из временных файлов
+func (cw *convertWriter) close() error {
+
+	var result error
+	for _, output := range cw.sortedOutputs() {
+		if err := cw.closeOutput(output); err != nil && result == nil {
+			result = fmt.Errorf("%s: %v", output.path, err)
+		}
+	}
+	return result
+}
+
+func (cw *convertWriter) closeOutput(output *convertOutput) error {
+
+	err := output.w.Flush()
+	if cw.format == convertNDJSON {
+		if errClose := output.file.Close(); err == nil {
+			err = errClose
+		}
+		return err
+	}
+
+	defer os.Remove(output.file.Name())
+	defer output.file.Close()
+	if err != nil {
+		return err
+	}
+	if _, err := output.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	columns := output.getColumns()
+
+	result, err := os.Create(output.path)
+	if err != nil {
+		return err
+	}
+	if cw.format == convertCSV {
+		err = writeConvertCSV(output.file, result, columns)
+	} else {
+		err = writeConvertParquet(output.file, result, columns)
+	}
+	if errClose := result.Close(); err == nil {
+		err = errClose
+	}
+	return err
+}
+
+// getColumns колонки результата: @timestamp и event_techlog, затем остальные поля по имени
+func (o *convertOutput) getColumns() []parquetColumn {
+
+	var columns []parquetColumn
+	for name, column := range o.columns {
+		columns = append(columns, parquetColumn{Name: name, Type: column.columnType()})
+	}
+
+	rank := func(name string) int {
+		switch name {
+		case "@timestamp":
+			return 0
+		case "event_techlog":
+			return 1
+		}
+		return 2
+	}
+	sort.Slice(columns, func(i, j int) bool {
+		ri, rj := rank(columns[i].Name), rank(columns[j].Name)
+		if ri != rj {
+			return ri < rj
+		}
+		return columns[i].Name < columns[j].Name
+	})
+	return columns
+}
+
+// readConvertSpool читает события временного файла по одному
+func readConvertSpool(spool io.Reader, fn func(doc map[string]interface{}) error) error {
+
+	decoder := json.NewDecoder(bufio.NewReader(spool))
+	decoder.UseNumber()
+	for {
+		var doc map[string]interface{}
+		err := decoder.Decode(&doc)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(doc); err != nil {
+			return err
+		}
+	}
+}
+
+// getConvertString значение поля строкой: массивы и объекты - текстом JSON
+func getConvertString(value interface{}) (string, bool) {
+	switch value := value.(type) {
+	case nil:
+		return "", false
+	case string:
+		return value, true
+	case json.Number:
+		return value.String(), true
+	case bool:
+		return strconv.FormatBool(value), true
+	}
+	data, _ := json.Marshal(value)
+	return string(data), true
+}
+
+func writeConvertCSV(spool io.Reader, result io.Writer, columns []parquetColumn) error {
+
+	w := csv.NewWriter(bufio.NewWriter(result))
+	record := make([]string, len(columns))
+	for i, column := range columns {
+		record[i] = column.Name
+	}
+	if err := w.Write(record); err != nil {
+		return err
+	}
+
+	err := readConvertSpool(spool, func(doc map[string]interface{}) error {
+		for i, column := range columns {
+			record[i], _ = getConvertString(doc[column.Name])
+		}
+		return w.Write(record)
+	})
+	if err != nil {
+		return err
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func writeConvertParquet(spool io.Reader, result io.Writer, columns []parquetColumn) error {
+
+	pw := newParquetWriter(result, columns, parquetRowGroupSize)
+
+	row := make([]parquetValue, len(columns))
+	err := readConvertSpool(spool, func(doc map[string]interface{}) error {
+		for i, column := range columns {
+			row[i] = nil
+			value, ok := doc[column.Name]
+			if !ok || value == nil {
+				continue
+			}
+			switch column.Type {
+			case parquetInt64:
+				if number, ok := value.(json.Number); ok {
+					if v, err := number.Int64(); err == nil {
+						row[i] = v
+					}
+				}
+			case parquetTimestamp:
+				if text, ok := value.(string); ok {
+					if t, err := time.Parse(eventDateFormat, text); err == nil {
+						row[i] = t.UnixNano() / int64(time.Microsecond)
+					}
+				}
+			default:
+				row[i], _ = getConvertString(value)
+			}
+		}
+		return pw.write(row)
+	})
+	if err != nil {
+		return err
+	}
+	return pw.close()
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// события СУБД и другие события, которые 1С пишет внутри вызова, по умолчанию
+const defaultCorrelateEvents = "DBMSSQL|DBPOSTGRS|DBORACLE|DB2|DBV8DBENG|SDBL|TLOCK|TTIMEOUT|TDEADLOCK|EXCP"
+
+// окно ожидания вызова по умолчанию, в секундах
+const defaultCorrelateWindow = 600
+
+// сколько событий файла может ожидать вызова по умолчанию
+const defaultCorrelateMaxPending = 100000
+
+// событие вызова, с которым связываются события внутри него
+const correlateParentEvent = "CALL"
+
+// initCorrelation проверяет и разбирает настройки связывания событий с вызовами
+func (c *conf) initCorrelation() error {
+	events := c.CorrelateEvents
+	if events == "" {
+		events = defaultCorrelateEvents
+	}
+	re, err := regexp.Compile(fmt.Sprintf("(?i)^(%s)$", events))
+	if err != nil {
+		return err
+	}
+	c.reCorrelate = re
+	return nil
+}
+
+// getCorrelateWindow окно ожидания вызова
+func getCorrelateWindow(c *conf) time.Duration {
+	window := c.CorrelateWindow
+	if window <= 0 {
+		window = defaultCorrelateWindow
+	}
+	return time.Duration(window) * time.Second
+}
+
+// getCorrelateMaxPending сколько событий файла может ожидать вызова
+func getCorrelateMaxPending(c *conf) int {
+	if c.CorrelateMaxPending <= 0 {
+		return defaultCorrelateMaxPending
+	}
+	return c.CorrelateMaxPending
+}
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// fileEvent прочитанное событие файла вместе с исходным текстом и состоянием часов файла
+type fileEvent struct {
+	raw   *rawEvent
+	event *techLogEvent
+	// hour состояние часов файла после разбора события, с ним файл дочитывается с начала этого события
+	hour *hourState
+	// key ключ вызова, по которому событие ожидает CALL
+	key string
+	// done событие уже передано на отправку
+	done bool
+}
+
+// callCorrelator связывает события внутри вызова (DBMSSQL, SDBL, TLOCK...) с событием CALL.
+//
+// 1С пишет CALL по окончании вызова, после всех событий внутри него, в тот же файл процесса,
+// с теми же t:connectID, SessionID и OSThread. Поэтому события внутри вызова задерживаются до появления
+// их CALL, после чего получают общий call_id, контекст parent_context и длительность parent_duration вызова.
+// Событие, для которого вызов не появился за окно window (по времени событий файла), отправляется без связи.
+// Если ожидающих событий больше maxPending (много событий внутри долгих вызовов или события без CALL),
+// самые ранние из них отправляются без связи, чтобы очередь не занимала память без ограничения.
+type callCorrelator struct {
+	path       string
+	children   *regexp.Regexp
+	window     time.Duration
+	maxPending int
+	// pending ожидающие вызова события по ключу соединения и потока
+	pending map[string][]*fileEvent
+	// queue ожидающие события в порядке файла, первое - самое раннее
+	queue []*fileEvent
+	// count ожидающие события очереди, еще не переданные на отправку
+	count int
+}
+
+func newCallCorrelator(path string, children *regexp.Regexp, window time.Duration, maxPending int) *callCorrelator {
+	return &callCorrelator{
+		path:       path,
+		children:   children,
+		window:     window,
+		maxPending: maxPending,
+		pending:    make(map[string][]*fileEvent),
+	}
+}
+
+// correlationKey ключ вызова: соединение, сеанс и поток процесса
+func correlationKey(event *techLogEvent) string {
+	thread := event.getString("osthread")
+	if thread == "" {
+		return ""
+	}
+	return event.getString("t_connectid") + "/" + event.getString("sessionid") + "/" + thread
+}
+
+// getCallID идентификатор вызова: файл и смещение события CALL
+func getCallID(path string, raw *rawEvent) string {
+	hash := md5.Sum([]byte(path + ":" + strconv.FormatInt(raw.Start, 10)))
+	return hex.EncodeToString(hash[:])
+}
+
+// add принимает очередное событие файла и возвращает события, готовые к отправке
+func (c *callCorrelator) add(item *fileEvent) []*fileEvent {
+
+	ready := c.expire(item.event.Time)
+	event := item.event
+	key := correlationKey(event)
+
+	switch {
+	case key != "" && event.Name == correlateParentEvent:
+		callID := getCallID(c.path, item.raw)
+		event.Fields["call_id"] = callID
+
+		// события внутри вызова не раньше его начала
+		started := event.Time.Add(-time.Duration(event.Duration) * time.Microsecond)
+		for _, child := range c.pending[key] {
+			if !event.Time.IsZero() && !child.event.Time.Before(started) {
+				child.event.Fields["call_id"] = callID
+				child.event.Fields["parent_duration"] = event.Duration
+				if context, ok := event.Fields["context"]; ok {
+					child.event.Fields["parent_context"] = copyValue(context)
+				}
+			}
+			child.done = true
+			c.count--
+			ready = append(ready, child)
+		}
+		delete(c.pending, key)
+		ready = append(ready, item)
+
+	case key != "" && !event.Time.IsZero() && c.children.MatchString(event.Name):
+		item.key = key
+		c.pending[key] = append(c.pending[key], item)
+		c.queue = append(c.queue, item)
+		c.count++
+		ready = append(ready, c.evict()...)
+
+	default:
+		ready = append(ready, item)
+	}
+
+	c.compact()
+	return ready
+}
+
+// evict возвращает самые ранние ожидающие события сверх maxPending
+func (c *callCorrelator) evict() []*fileEvent {
+
+	var ready []*fileEvent
+	for _, item := range c.queue {
+		if c.maxPending <= 0 || c.count <= c.maxPending {
+			break
+		}
+		if item.done {
+			continue
+		}
+		item.done = true
+		c.count--
+		c.removePending(item)
+		ready = append(ready, item)
+	}
+	return ready
+}
+
+// expire возвращает ожидающие события, для которых вызов не появился за окно до момента now
+func (c *callCorrelator) expire(now time.Time) []*fileEvent {
+
+	var ready []*fileEvent
+	if now.IsZero() {
+		return ready
+	}
+	deadline := now.Add(-c.window)
+	for _, item := range c.queue {
+		if item.done {
+			continue
+		}
+		if !item.event.Time.Before(deadline) {
+			break
+		}
+		item.done = true
+		c.count--
+		c.removePending(item)
+		ready = append(ready, item)
+	}
+	return ready
+}
+
+// removePending убирает событие из ожидающих вызова по ключу
+func (c *callCorrelator) removePending(item *fileEvent) {
+	items := c.pending[item.key]
+	for i, pending := range items {
+		if pending == item {
+			items = append(items[:i], items[i+1:]...)
+			break
+		}
+	}
+	if len(items) == 0 {
+		delete(c.pending, item.key)
+	} else {
+		c.pending[item.key] = items
+	}
+}
+
+// flush возвращает все ожидающие события без связи с вызовом, когда файл больше не дописывается
+func (c *callCorrelator) flush() []*fileEvent {
+
+	var ready []*fileEvent
+	for _, item := range c.queue {
+		if !item.done {
+			item.done = true
+			ready = append(ready, item)
+		}
+	}
+	c.queue = nil
+	c.pending = make(map[string][]*fileEvent)
+	c.count = 0
+	return ready
+}
+
+// earliest возвращает самое раннее ожидающее событие, nil - ожидающих нет
+func (c *callCorrelator) earliest() *fileEvent {
+	c.compact()
+	if len(c.queue) == 0 {
+		return nil
+	}
+	return c.queue[0]
+}
+
+// compact убирает отправленные события из начала очереди
+func (c *callCorrelator) compact() {
+	n := 0
+	for n < len(c.queue) && c.queue[n].done {
+		c.queue[n] = nil
+		n++
+	}
+	c.queue = c.queue[n:]
+}
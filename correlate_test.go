@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// testCallFields свойства соединения и сеанса событий теста, событие длится 5 секунд
+const testCallFields = ",t:connectID=1,SessionID=2,Context=Форма.Записать"
+
+func TestCallCorrelator(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		window     time.Duration
+		maxPending int
+		events     []rawEvent
+		// ready события, переданные на отправку после каждого события, с признаком связи с вызовом
+		ready []string
+		// earliest смещение самого раннего ожидающего события, -1 - ожидающих нет
+		earliest int64
+	}{
+		{
+			name:       "child is correlated with its call",
+			window:     time.Minute,
+			maxPending: 10,
+			events: []rawEvent{
+				{Start: 0, Header: "00:01.000000", Body: "5000000,DBMSSQL,1,OSThread=10" + testCallFields},
+				{Start: 10, Header: "00:02.000000", Body: "5000000,CALL,1,OSThread=10" + testCallFields},
+			},
+			ready:    []string{"", "DBMSSQL:call CALL:call"},
+			earliest: -1,
+		},
+		{
+			name:       "child without call expires after window",
+			window:     time.Minute,
+			maxPending: 10,
+			events: []rawEvent{
+				{Start: 0, Header: "00:01.000000", Body: "5000000,DBMSSQL,1,OSThread=10" + testCallFields},
+				{Start: 10, Header: "00:30.000000", Body: "5000000,SDBL,1,OSThread=11" + testCallFields},
+				{Start: 20, Header: "01:02.000000", Body: "5000000,EXCP,1,OSThread=12" + testCallFields},
+			},
+			ready:    []string{"", "", "DBMSSQL:-"},
+			earliest: 10,
+		},
+		{
+			name:       "pending over limit is sent uncorrelated",
+			window:     time.Hour,
+			maxPending: 2,
+			events: []rawEvent{
+				{Start: 0, Header: "00:01.000000", Body: "5000000,DBMSSQL,1,OSThread=10" + testCallFields},
+				{Start: 10, Header: "00:02.000000", Body: "5000000,DBMSSQL,1,OSThread=11" + testCallFields},
+				{Start: 20, Header: "00:03.000000", Body: "5000000,DBMSSQL,1,OSThread=12" + testCallFields},
+				{Start: 30, Header: "00:04.000000", Body: "5000000,CALL,1,OSThread=10" + testCallFields},
+				{Start: 40, Header: "00:05.000000", Body: "5000000,DBMSSQL,1,OSThread=13" + testCallFields},
+			},
+			ready:    []string{"", "", "DBMSSQL:-", "CALL:call", "DBMSSQL:-"},
+			earliest: 20,
+		},
+	}
+
+	config := &conf{Path: "logs"}
+	for _, tt := range tests {
+		c := newCallCorrelator("rphost_1/24010203.log", regexp.MustCompile("^(DBMSSQL|SDBL|EXCP)$"), tt.window, tt.maxPending)
+		for i := range tt.events {
+			raw := &tt.events[i]
+			got := ""
+			for _, ready := range c.add(&fileEvent{raw: raw, event: parseTestEvent(t, config, raw, nil)}) {
+				if got != "" {
+					got += " "
+				}
+				_, correlated := ready.event.Fields["call_id"]
+				if correlated {
+					got += ready.event.Name + ":call"
+				} else {
+					got += ready.event.Name + ":-"
+				}
+			}
+			if got != tt.ready[i] {
+				t.Errorf("%s: event %d: ready %q, want %q", tt.name, i, got, tt.ready[i])
+			}
+		}
+
+		earliest := int64(-1)
+		if first := c.earliest(); first != nil {
+			earliest = first.raw.Start
+		}
+		if earliest != tt.earliest {
+			t.Errorf("%s: earliest %d, want %d", tt.name, earliest, tt.earliest)
+		}
+		if c.count > tt.maxPending {
+			t.Errorf("%s: %d pending, limit %d", tt.name, c.count, tt.maxPending)
+		}
+	}
+}
+
+func TestCallCorrelatorMaxPending(t *testing.T) {
+
+	config := &conf{Path: "logs"}
+	c := newCallCorrelator("rphost_1/24010203.log", regexp.MustCompile("^DBMSSQL$"), time.Hour, 100)
+	sent := 0
+	for i := 0; i < 1000; i++ {
+		raw := &rawEvent{Header: "00:01.000000", Body: fmt.Sprintf("5000000,DBMSSQL,1,OSThread=%d", i) + testCallFields, Start: int64(i * 10)}
+		sent += len(c.add(&fileEvent{raw: raw, event: parseTestEvent(t, config, raw, nil)}))
+		if c.count > 100 || len(c.queue) > 100 {
+			t.Fatalf("event %d: %d pending, queue %d", i, c.count, len(c.queue))
+		}
+	}
+	if sent != 900 || len(c.flush()) != 100 {
+		t.Errorf("sent %d of 1000 before flush", sent)
+	}
+}
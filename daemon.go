@@ -0,0 +1,167 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	logr "github.com/sirupsen/logrus"
+)
+
+// минимальный интервал между проходами, чтобы непрерывная запись 1С не вызывала проход на каждое событие ФС
+const daemonMinPassInterval = time.Second
+
+// интервал опроса каталога по умолчанию, в секундах
+const daemonDefaultPollInterval = 5
+
+// isStopped проверяет, была ли запрошена остановка службы
+func isStopped(stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// notify неблокирующе сообщает основному циклу о появлении новых данных
+func notify(trigger chan<- struct{}) {
+	select {
+	case trigger <- struct{}{}:
+	default:
+	}
+}
+
+// startWatcher подписывается на изменения в каталоге тех журнала и всех его подкаталогах.
+// Новые каталоги процессов (rphost_NNN и т.п.) добавляются в наблюдение по мере появления.
+func startWatcher(root string, trigger chan<- struct{}, stop <-chan struct{}) (*fsnotify.Watcher, error) {
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			return watcher.Add(path)
+		}
+		return nil
+	})
+	if err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Op&fsnotify.Create == fsnotify.Create {
+					if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+						watcher.Add(event.Name)
+					}
+				}
+				if event.Op&(fsnotify.Create|fsnotify.Write) != 0 {
+					notify(trigger)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logr.WithFields(logr.Fields{
+					"object": "Daemon",
+					"title":  "Watcher error",
+				}).Warning(err)
+			}
+		}
+	}()
+
+	return watcher, nil
+}
+
+// runDaemon запускает парсер в режиме службы: каталог тех журнала отслеживается непрерывно,
+// дописанные данные и новые часовые файлы обрабатываются сразу после появления.
+// По SIGTERM/SIGINT текущие файлы дочитываются и отправляются, позиции сохраняются, после чего служба завершается.
+func runDaemon(config *conf, store checkpointStore) {
+
+	stop := make(chan struct{})
+	trigger := make(chan struct{}, 1)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-signals
+		logr.WithFields(logr.Fields{
+			"object": "Daemon",
+			"title":  "Shutdown",
+		}).Infof("Received %v, finishing current files", sig)
+		close(stop)
+	}()
+
+	// события файловой системы в каталогах всех источников, при недоступности - только опрос каталога
+	if config.DaemonWatch {
+		for _, source := range config.sources {
+			watcher, err := startWatcher(source.Path, trigger, stop)
+			if err != nil {
+				logr.WithFields(logr.Fields{
+					"object": "Daemon",
+					"title":  "Watcher is unavailable, polling only",
+					"source": source.Name,
+				}).Warning(err)
+				continue
+			}
+			defer watcher.Close()
+		}
+	}
+
+	pollInterval := config.DaemonPollInterval
+	if pollInterval <= 0 {
+		pollInterval = daemonDefaultPollInterval
+	}
+	ticker := time.NewTicker(time.Second * time.Duration(pollInterval))
+	defer ticker.Stop()
+
+	_, _, logDay := time.Now().Date()
+
+	for {
+		passStarted := time.Now()
+		// ошибка прохода не останавливает службу: непрочитанные файлы будут прочитаны на следующем проходе
+		if err := processTechLogs(config, store, stop); err != nil {
+			logr.WithFields(logr.Fields{
+				"object": "Daemon",
+				"title":  "Pass completed with errors",
+			}).Error(err)
+		}
+
+		// ротация лога программы и очистка хранилища позиций при смене суток
+		if _, _, day := time.Now().Date(); day != logDay {
+			logDay = day
+			initLogging(config)
+			deleteOldLogFiles(config)
+			store.deleteUnused()
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-trigger:
+		case <-ticker.C:
+		}
+
+		if wait := daemonMinPassInterval - time.Since(passStarted); wait > 0 {
+			select {
+			case <-stop:
+				return
+			case <-time.After(wait):
+			}
+		}
+	}
+}
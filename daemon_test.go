@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestJobExtractContinuesAfterFileError(t *testing.T) {
+
+	dir := t.TempDir()
+	logs := filepath.Join(dir, "logs")
+	good := filepath.Join(logs, "rphost_1", "24010203.log")
+	missing := filepath.Join(logs, "rphost_2", "24010203.log")
+	os.MkdirAll(filepath.Dir(good), 0755)
+	body := "04:05.000001-10,CALL,1,Usr=Иванов\n04:05.000002-20,CALL,1,Usr=Петров\n"
+	if err := ioutil.WriteFile(good, []byte(body), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &conf{Path: logs, Outputs: []outputConf{{Type: outputFile, Path: filepath.Join(dir, "out", "{event}.ndjson")}}}
+	if err := config.initSources(); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.initOutputs(); err != nil {
+		t.Fatal(err)
+	}
+	store, err := newFileStore(filepath.Join(dir, "checkpoints.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var pack []files
+	for _, path := range []string{missing, good} {
+		file := files{Path: path, Size: int64(len(body)), FileDate: "24010203", Source: config.sources[0]}
+		if !store.lockFile(path) {
+			t.Fatalf("%s is locked", path)
+		}
+		pack = append(pack, file)
+	}
+
+	// файл, который не удалось открыть, не останавливает задание и не сохраняет позицию
+	c := make(chan jobResult, 1)
+	jobExtractTechLogs(pack, 7, config, store, c, nil)
+	result := <-c
+	if result.id != 7 || result.err == nil || !strings.Contains(result.err.Error(), missing) {
+		t.Fatalf("result %+v", result)
+	}
+	for _, path := range []string{missing, good} {
+		if !store.lockFile(path) {
+			t.Errorf("%s is still locked", path)
+		}
+	}
+	if cp := store.getCheckpoint(missing); cp.Position != 0 {
+		t.Errorf("position of missing file %d", cp.Position)
+	}
+	if cp := store.getCheckpoint(good); cp.Position != int64(len(body)) {
+		t.Errorf("position of readable file %d, want %d", cp.Position, len(body))
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "out", "call.ndjson")); strings.Count(string(data), "\n") != 2 {
+		t.Errorf("output %q", data)
+	}
+}
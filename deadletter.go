@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+)
+
+// приемники отклоненных документов
+const (
+	deadLetterFile  = "file"
+	deadLetterIndex = "index"
+	deadLetterNone  = "none"
+	// отклоненные документы собираются в памяти, при повторной отправке
+	deadLetterMemory = "memory"
+)
+
+// файл отклоненных документов по умолчанию
+const defaultDeadLetterFile = "./techLog1C_deadletter.ndjson"
+
+// индекс отклоненных документов по умолчанию
+const defaultDeadLetterIndex = "tech_journal_deadletter"
+
+// карта индекса отклоненных документов: документ хранится строкой без индексации,
+// чтобы отказ по маппингу исходного индекса не повторился в индексе отклоненных
+const deadLetterMapping = `{
+	"mappings": {
+		"properties": {
+			"time": { "type": "date" },
+			"output": { "type": "keyword" },
+			"index": { "type": "keyword" },
+			"id": { "type": "keyword" },
+			"key": { "type": "keyword" },
+			"event": { "type": "keyword" },
+			"source_file": { "type": "keyword" },
+			"status": { "type": "integer" },
+			"error_type": { "type": "keyword" },
+			"error_reason": { "type": "text" },
+			"cause_type": { "type": "keyword" },
+			"cause_reason": { "type": "text" },
+			"document": { "type": "text", "index": false }
+		}
+	}
+}`
+
+// deadLetter документ, который Elasticsearch отказался индексировать, с причиной отказа
+type deadLetter struct {
+	Time string `json:"time"`
+	// Output имя приемника, отклонившего документ
+	Output string `json:"output,omitempty"`
+	Index  string `json:"index"`
+	ID     string `json:"id"`
+	// Key ключ сообщения Kafka
+	Key         string `json:"key,omitempty"`
+	Event       string `json:"event"`
+	SourceFile  string `json:"source_file"`
+	Status      int    `json:"status"`
+	ErrorType   string `json:"error_type"`
+	ErrorReason string `json:"error_reason"`
+	CauseType   string `json:"cause_type,omitempty"`
+	CauseReason string `json:"cause_reason,omitempty"`
+	// Document исходный документ в JSON
+	Document string `json:"document"`
+}
+
+// deadLetterSink приемник отклоненных документов: файл NDJSON или отдельный индекс Elasticsearch
+type deadLetterSink struct {
+	mu     sync.Mutex
+	config *conf
+	mode   string
+	path   string
+	index  string
+	// letters отклоненные документы приемника deadLetterMemory
+	letters []*deadLetter
+}
+
+// initDeadLetters проверяет и разбирает настройки приемника отклоненных документов
+func (c *conf) initDeadLetters() error {
+
+	sink := &deadLetterSink{
+		config: c,
+		mode:   c.DeadLetter,
+		path:   c.DeadLetterFile,
+		index:  c.DeadLetterIndex,
+	}
+	if sink.mode == "" {
+		sink.mode = deadLetterFile
+	}
+	if sink.path == "" {
+		sink.path = defaultDeadLetterFile
+	}
+	if sink.index == "" {
+		sink.index = defaultDeadLetterIndex
+	}
+
+	switch sink.mode {
+	case deadLetterFile, deadLetterNone:
+	case deadLetterIndex:
+		// индекс отклоненных хранится в кластере приемника Elasticsearch
+		if _, err := c.getDeadLetterOutput(""); err != nil {
+			return fmt.Errorf("dead_letter: index: %v", err)
+		}
+	default:
+		return fmt.Errorf("unknown dead_letter %q", sink.mode)
+	}
+	c.deadLetters = sink
+	return nil
+}
+
+// write сохраняет отклоненные документы. Ошибка записи означает, что документы не сохранены
+// и позицию файла тех журнала сдвигать нельзя.
+func (s *deadLetterSink) write(letters []*deadLetter) error {
+
+	if len(letters) == 0 || s.mode == deadLetterNone {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch s.mode {
+	case deadLetterIndex:
+		return s.writeIndex(letters)
+	case deadLetterMemory:
+		s.letters = append(s.letters, letters...)
+		return nil
+	}
+	return s.writeFile(s.path, letters)
+}
+
+func (s *deadLetterSink) writeFile(path string, letters []*deadLetter) error {
+
+	var buf bytes.Buffer
+	for _, letter := range letters {
+		data, err := json.Marshal(letter)
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+		buf.WriteString("\n")
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(buf.Bytes()); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// writeIndex сохраняет отклоненные документы под их исходными идентификаторами в индекс отклоненных
+// кластера приемника, отклонившего документ, поэтому повторный отказ того же документа заменяет прежнюю запись
+func (s *deadLetterSink) writeIndex(letters []*deadLetter) error {
+
+	byOutput, outputs, err := s.config.groupDeadLetters(letters)
+	if err != nil {
+		return err
+	}
+
+	for _, oc := range outputs {
+		es, err := createElasticsearchClient(getElasticConf(s.config, oc))
+		if err != nil {
+			return err
+		}
+		if err := ensureIndex(es, s.index, deadLetterMapping); err != nil {
+			return err
+		}
+
+		var buf bytes.Buffer
+		for _, letter := range byOutput[oc.Name] {
+			data, err := json.Marshal(letter)
+			if err != nil {
+				return err
+			}
+			buf.WriteString(fmt.Sprintf(`{ "index" : { "_index" : "%s","_id" : "%s" } }%s`, s.index, letter.ID, "\n"))
+			buf.Write(data)
+			buf.WriteString("\n")
+		}
+
+		rejections, err := executeBulk(es, s.index, buf.Bytes())
+		if err != nil {
+			return err
+		}
+		if len(rejections) > 0 {
+			r := rejections[0]
+			return fmt.Errorf("[%d] %s: %s", r.Status, r.ErrorType, r.ErrorReason)
+		}
+	}
+	return nil
+}
+
+// replayResult итог повторной отправки отклоненных документов
+type replayResult struct {
+	Replayed int
+	Rejected int
+}
+
+// replay повторно отправляет отклоненные документы в их индексы, например после исправления карт.
+// Документы, которые снова отклонены, остаются в приемнике с новой причиной отказа.
+func (s *deadLetterSink) replay() (replayResult, error) {
+
+	switch s.mode {
+	case deadLetterFile:
+		return s.replayFile()
+	case deadLetterIndex:
+		return s.replayIndex()
+	}
+	return replayResult{}, fmt.Errorf("dead_letter is %q, nothing to replay", s.mode)
+}
+
+// replayFile переименовывает файл отклоненных документов, чтобы парсер, работающий в это время,
+// писал новые отказы в новый файл, и отправляет документы из переименованных файлов.
+// Переименованный файл, оставшийся после прерванной отправки, отправляется при следующем запуске.
+func (s *deadLetterSink) replayFile() (replayResult, error) {
+
+	var result replayResult
+
+	if _, err := os.Stat(s.path); err == nil {
+		pending := fmt.Sprintf("%s.%d.replay", s.path, time.Now().UnixNano())
+		if err := os.Rename(s.path, pending); err != nil {
+			return result, err
+		}
+	}
+
+	paths, err := filepath.Glob(s.path + ".*.replay")
+	if err != nil {
+		return result, err
+	}
+
+	for _, path := range paths {
+		letters, err := readDeadLetters(path)
+		if err != nil {
+			return result, err
+		}
+		rejected, err := resendDeadLetters(s.config, letters)
+		if err != nil {
+			return result, err
+		}
+		if err := s.write(rejected); err != nil {
+			return result, err
+		}
+		if err := os.Remove(path); err != nil {
+			return result, err
+		}
+		result.Replayed += len(letters) - len(rejected)
+		result.Rejected += len(rejected)
+	}
+	return result, nil
+}
+
+// replayIndex отправляет документы из индексов отклоненных всех кластеров приемников Elasticsearch
+// и удаляет из них принятые
+func (s *deadLetterSink) replayIndex() (replayResult, error) {
+
+	var result replayResult
+
+	clusters := make(map[string]bool)
+	for _, oc := range s.config.outputs {
+		if oc.Type != outputElastic || clusters[oc.URL] {
+			continue
+		}
+		clusters[oc.URL] = true
+
+		es, err := createElasticsearchClient(getElasticConf(s.config, oc))
+		if err != nil {
+			return result, err
+		}
+		letters, err := searchDeadLetters(es, s.index)
+		if err != nil {
+			return result, err
+		}
+
+		rejected, err := resendDeadLetters(s.config, letters)
+		if err != nil {
+			return result, err
+		}
+		stillRejected := make(map[string]bool)
+		for _, letter := range rejected {
+			stillRejected[letter.ID] = true
+		}
+
+		var buf bytes.Buffer
+		for _, letter := range letters {
+			if !stillRejected[letter.ID] {
+				buf.WriteString(fmt.Sprintf(`{ "delete" : { "_index" : "%s","_id" : "%s" } }%s`, s.index, letter.ID, "\n"))
+			}
+		}
+		if buf.Len() > 0 {
+			res, err := es.Bulk(bytes.NewReader(buf.Bytes()), es.Bulk.WithIndex(s.index))
+			if err != nil {
+				return result, err
+			}
+			res.Body.Close()
+			if res.IsError() {
+				return result, fmt.Errorf("delete replayed documents: %s", res.Status())
+			}
+		}
+		if err := s.write(rejected); err != nil {
+			return result, err
+		}
+
+		result.Replayed += len(letters) - len(rejected)
+		result.Rejected += len(rejected)
+	}
+	return result, nil
+}
+
+// readDeadLetters читает записи файла отклоненных документов
+func readDeadLetters(path string) ([]*deadLetter, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var letters []*deadLetter
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1<<30)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var letter deadLetter
+		if err := json.Unmarshal(line, &letter); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		letters = append(letters, &letter)
+	}
+	return letters, scanner.Err()
+}
+
+// searchDeadLetters читает все записи индекса отклоненных документов
+func searchDeadLetters(es *elasticsearch.Client, index string) ([]*deadLetter, error) {
+
+	type searchResponse struct {
+		ScrollID string `json:"_scroll_id"`
+		Hits     struct {
+			Hits []struct {
+				Source deadLetter `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+
+	var letters []*deadLetter
+
+	res, err := es.Search(
+		es.Search.WithIndex(index),
+		es.Search.WithSize(1000),
+		es.Search.WithScroll(time.Minute),
+		es.Search.WithIgnoreUnavailable(true),
+	)
+	for {
+		if err != nil {
+			return nil, err
+		}
+		if res.IsError() {
+			res.Body.Close()
+			return nil, fmt.Errorf("search %s: %s", index, res.Status())
+		}
+
+		var sr searchResponse
+		err = json.NewDecoder(res.Body).Decode(&sr)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if len(sr.Hits.Hits) == 0 {
+			if sr.ScrollID != "" {
+				if res, err := es.ClearScroll(es.ClearScroll.WithScrollID(sr.ScrollID)); err == nil {
+					res.Body.Close()
+				}
+			}
+			return letters, nil
+		}
+		for i := range sr.Hits.Hits {
+			letters = append(letters, &sr.Hits.Hits[i].Source)
+		}
+
+		res, err = es.Scroll(es.Scroll.WithScrollID(sr.ScrollID), es.Scroll.WithScroll(time.Minute))
+	}
+}
+
+// resendDeadLetters передает документы повторной отправке приемника, отклонившего их: документы
+// Elasticsearch - в исходные индексы, строки ClickHouse - в исходные таблицы, сообщения Kafka - в исходные
+// топики, документы, не принятые приемником целиком, - приемнику как при чтении файла. Возвращает
+// снова отклоненные документы с новой причиной отказа.
+func resendDeadLetters(config *conf, letters []*deadLetter) ([]*deadLetter, error) {
+
+	var rejected []*deadLetter
+	var elastic []*deadLetter
+	byOther := make(map[string][]*deadLetter)
+	byOutput := make(map[string][]*deadLetter)
+	for _, letter := range letters {
+		if letter.Index == "" {
+			// документ не принят приемником целиком, например производный документ анализа блокировок
+			byOutput[letter.Output] = append(byOutput[letter.Output], letter)
+			continue
+		}
+		switch config.getOutputType(letter.Output) {
+		case outputClickHouse, outputKafka:
+			byOther[letter.Output] = append(byOther[letter.Output], letter)
+		default:
+			elastic = append(elastic, letter)
+		}
+	}
+	for _, oc := range config.outputs {
+		if len(byOther[oc.Name]) == 0 {
+			continue
+		}
+		var letters []*deadLetter
+		var err error
+		if oc.Type == outputClickHouse {
+			letters, err = resendClickHouseDeadLetters(config, oc, byOther[oc.Name])
+		} else {
+			letters, err = resendKafkaDeadLetters(config, oc, byOther[oc.Name])
+		}
+		if err != nil {
+			return nil, err
+		}
+		rejected = append(rejected, letters...)
+	}
+
+	for name, letters := range byOutput {
+		oc, ok := config.getOutputConf(name)
+		if !ok {
+			var err error
+			if oc, err = config.getDeadLetterOutput(name); err != nil {
+				return nil, err
+			}
+		}
+		letters, err := resendOutputDeadLetters(config, oc, letters)
+		if err != nil {
+			return nil, err
+		}
+		rejected = append(rejected, letters...)
+	}
+
+	letters, err := resendElasticDeadLetters(config, elastic)
+	if err != nil {
+		return nil, err
+	}
+	return append(rejected, letters...), nil
+}
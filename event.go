@@ -0,0 +1,320 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	// база часовых поясов на случай, если в системе ее нет (Windows)
+	_ "time/tzdata"
+)
+
+// формат даты события в документе: RFC3339 с микросекундами и смещением часового пояса
+const eventDateFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// допустимое отставание времени события от предыдущего в том же файле. Большее отставание
+// в часе, который повторяется при переводе часов назад, означает переход ко второму проходу часа.
+const eventClockTolerance = time.Minute
+
+// числовые свойства событий, значения которых выводятся целыми числами
+var numericProperties = map[string]bool{
+	"duration":     true,
+	"stack":        true,
+	"memory":       true,
+	"memorypeak":   true,
+	"inbytes":      true,
+	"outbytes":     true,
+	"cputime":      true,
+	"callwait":     true,
+	"rows":         true,
+	"rowsaffected": true,
+	"trans":        true,
+	"calls":        true,
+	"err":          true,
+	"port":         true,
+	"syncport":     true,
+	"nmb":          true,
+	"isattached":   true,
+	"protected":    true,
+}
+
+// techLogEvent разобранное событие тех журнала с типизированными значениями свойств
+type techLogEvent struct {
+	// Time время события, нулевое - если время не удалось определить
+	Time time.Time
+	// Name имя события: CALL, DBMSSQL, TLOCK...
+	Name string
+	// Duration длительность события в микросекундах
+	Duration int64
+	// Fields свойства события: string, []string, int64 или []int64 для числовых свойств
+	Fields map[string]interface{}
+}
+
+// document возвращает событие в виде документа для отправки
+func (e *techLogEvent) document() map[string]interface{} {
+
+	doc := make(map[string]interface{}, len(e.Fields)+2)
+	for key, value := range e.Fields {
+		doc[key] = value
+	}
+	if !e.Time.IsZero() {
+		date := e.Time.Format(eventDateFormat)
+		doc["@timestamp"] = date
+		doc["date"] = date
+	}
+	return doc
+}
+
+// getString возвращает строковое значение свойства
+func (e *techLogEvent) getString(name string) string {
+	switch value := e.Fields[name].(type) {
+	case string:
+		return value
+	case []string:
+		if len(value) > 0 {
+			return value[0]
+		}
+	case int64:
+		return strconv.FormatInt(value, 10)
+	case []int64:
+		if len(value) > 0 {
+			return strconv.FormatInt(value[0], 10)
+		}
+	}
+	return ""
+}
+
+// parseEventHeader разбирает заголовок события mm:ss.uuuuuu. Возвращает смещение события от начала часа
+// и множитель для приведения длительности к микросекундам: 8.3 пишет время и длительность
+// в микросекундах (6 знаков), 8.2 - в десятитысячных долях секунды (4 знака).
+func parseEventHeader(header string) (time.Duration, int64, error) {
+
+	if len(header) < 7 || header[2] != ':' || header[5] != '.' {
+		return 0, 0, fmt.Errorf("invalid event header %q", header)
+	}
+
+	minutes, err := strconv.Atoi(header[0:2])
+	if err != nil {
+		return 0, 0, err
+	}
+	seconds, err := strconv.Atoi(header[3:5])
+	if err != nil {
+		return 0, 0, err
+	}
+
+	fraction := header[6:]
+	digits := len(fraction)
+	if digits > 9 {
+		return 0, 0, fmt.Errorf("invalid event header %q", header)
+	}
+	frac, err := strconv.ParseInt(fraction, 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	nanos := frac
+	for i := digits; i < 9; i++ {
+		nanos *= 10
+	}
+
+	var multiplier int64 = 1
+	for i := digits; i < 6; i++ {
+		multiplier *= 10
+	}
+
+	offset := time.Duration(minutes)*time.Minute + time.Duration(seconds)*time.Second + time.Duration(nanos)
+	return offset, multiplier, nil
+}
+
+// loadLocation загружает часовой пояс по имени IANA (Europe/Moscow), пустое имя - местный пояс сервера парсера
+func loadLocation(name string) (*time.Location, error) {
+	if name == "" || strings.EqualFold(name, "local") {
+		return time.Local, nil
+	}
+	return time.LoadLocation(name)
+}
+
+// hourState состояние разбора файла за час, который повторяется при переходе на зимнее время.
+// Сохраняется вместе с позицией файла, чтобы при дочитывании файла второй проход часа не был принят за первый.
+type hourState struct {
+	// Fold события файла относятся ко второму проходу часа
+	Fold bool `json:"fold"`
+	// Last смещение последнего события от начала часа, в наносекундах
+	Last int64 `json:"last"`
+}
+
+// eventClock вычисляет время событий одного файла тех журнала.
+// 1С называет файлы по местному времени сервера yymmddhh, время события внутри файла - mm:ss.uuuuuu.
+// При переводе часов назад час повторяется и оба прохода пишутся в один файл, при переводе вперед
+// часа не существует и файла за него обычно нет.
+type eventClock struct {
+	valid bool
+	// first и second начало часа в первом и во втором проходе, совпадают, если час не повторяется
+	first  time.Time
+	second time.Time
+	state  hourState
+}
+
+// newEventClock создает часы файла за час fileDate (yymmddhh) в часовом поясе loc
+func newEventClock(fileDate string, loc *time.Location, state hourState) *eventClock {
+
+	clock := &eventClock{state: state}
+
+	wall, err := time.Parse("06010215", fileDate)
+	if err != nil {
+		return clock
+	}
+	if loc == nil {
+		loc = time.Local
+	}
+
+	clock.valid = true
+	clock.first, clock.second = resolveWallHour(wall, loc)
+	if clock.first.Equal(clock.second) {
+		clock.state = hourState{}
+	}
+	return clock
+}
+
+// resolveWallHour возвращает начало часа, заданного местным временем wall (в UTC без смещения),
+// в первом и во втором проходе. Несуществующий час (перевод часов вперед) отсчитывается
+// по смещению, действовавшему до перевода.
+func resolveWallHour(wall time.Time, loc *time.Location) (time.Time, time.Time) {
+
+	guess := time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour(), 0, 0, 0, loc)
+	_, offsetBefore := guess.Add(-6 * time.Hour).Zone()
+	_, offsetAfter := guess.Add(6 * time.Hour).Zone()
+
+	before := wall.Add(-time.Duration(offsetBefore) * time.Second).In(loc)
+	after := wall.Add(-time.Duration(offsetAfter) * time.Second).In(loc)
+
+	isWall := func(t time.Time) bool {
+		return t.Hour() == wall.Hour() && t.Day() == wall.Day()
+	}
+
+	switch {
+	case isWall(before) && isWall(after):
+		if after.Before(before) {
+			return after, before
+		}
+		return before, after
+	case isWall(after):
+		return after, after
+	default:
+		return before, before
+	}
+}
+
+// time возвращает время события по смещению от начала часа
+func (c *eventClock) time(offset time.Duration) time.Time {
+
+	if !c.valid {
+		return time.Time{}
+	}
+	if c.first.Equal(c.second) {
+		return c.first.Add(offset)
+	}
+
+	if !c.state.Fold && time.Duration(c.state.Last)-offset > eventClockTolerance {
+		c.state.Fold = true
+	}
+	c.state.Last = int64(offset)
+
+	if c.state.Fold {
+		return c.second.Add(offset)
+	}
+	return c.first.Add(offset)
+}
+
+// hourEnded проверяет, что час файла закончился и 1С его больше не дописывает
+func (c *eventClock) hourEnded(now time.Time) bool {
+	return !c.valid || now.After(c.second.Add(time.Hour+time.Minute))
+}
+
+// hourState возвращает состояние для сохранения вместе с позицией, nil - час не повторяется
+func (c *eventClock) hourState() *hourState {
+	if !c.valid || c.first.Equal(c.second) {
+		return nil
+	}
+	state := c.state
+	return &state
+}
+
+// newTechLogEvent приводит значения числовых свойств к целым, длительность - к микросекундам
+func newTechLogEvent(fields map[string]interface{}, clock *eventClock, header string) *techLogEvent {
+
+	event := &techLogEvent{Fields: fields}
+	event.Name, _ = fields["event_techlog"].(string)
+
+	offset, multiplier, errHeader := parseEventHeader(header)
+	if errHeader == nil {
+		event.Time = clock.time(offset)
+	}
+
+	for name, value := range fields {
+		property, ok := getNumericProperty(name)
+		if !ok {
+			continue
+		}
+		scale := int64(1)
+		if property == "duration" && errHeader == nil {
+			scale = multiplier
+		}
+
+		switch value := value.(type) {
+		case string:
+			number, err := parseNumber(value)
+			if err != nil {
+				continue
+			}
+			fields[name] = number * scale
+		case []string:
+			numbers := make([]int64, len(value))
+			var err error
+			for i, v := range value {
+				if numbers[i], err = parseNumber(v); err != nil {
+					break
+				}
+				numbers[i] *= scale
+			}
+			if err == nil {
+				fields[name] = numbers
+			}
+		}
+	}
+
+	if errHeader == nil {
+		switch duration := fields["duration"].(type) {
+		case int64:
+			event.Duration = duration
+		case []int64:
+			if len(duration) > 0 {
+				event.Duration = duration[0]
+			}
+		}
+	}
+
+	return event
+}
+
+// getNumericProperty имя числового свойства по имени поля: поле повтора свойства с суффиксом номера
+// (rows_2) числовое, как и само свойство
+func getNumericProperty(name string) (string, bool) {
+	if numericProperties[name] {
+		return name, true
+	}
+	i := strings.LastIndexByte(name, '_')
+	if i <= 0 || i == len(name)-1 {
+		return "", false
+	}
+	if _, err := strconv.Atoi(name[i+1:]); err != nil {
+		return "", false
+	}
+	return name[:i], numericProperties[name[:i]]
+}
+
+// parseNumber разбирает целое значение свойства
+func parseNumber(value string) (int64, error) {
+	return strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseEventHeader(t *testing.T) {
+
+	tests := []struct {
+		header     string
+		offset     time.Duration
+		multiplier int64
+		fail       bool
+	}{
+		{header: "05:07.123456", offset: 5*time.Minute + 7*time.Second + 123456*time.Microsecond, multiplier: 1},
+		{header: "59:59.9999", offset: 59*time.Minute + 59*time.Second + 999900*time.Microsecond, multiplier: 100},
+		{header: "00:00.000000001", offset: time.Nanosecond, multiplier: 1},
+		{header: "5:07.123456", fail: true},
+		{header: "05:07", fail: true},
+		{header: "05:07.12345678901", fail: true},
+		{header: "05:xx.123456", fail: true},
+	}
+
+	for _, tt := range tests {
+		offset, multiplier, err := parseEventHeader(tt.header)
+		if tt.fail {
+			if err == nil {
+				t.Errorf("%s: no error", tt.header)
+			}
+			continue
+		}
+		if err != nil || offset != tt.offset || multiplier != tt.multiplier {
+			t.Errorf("%s: %v, %d, %v; want %v, %d", tt.header, offset, multiplier, err, tt.offset, tt.multiplier)
+		}
+	}
+}
+
+func TestEventClock(t *testing.T) {
+
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	tests := []struct {
+		name     string
+		fileDate string
+		loc      *time.Location
+		state    hourState
+		// headers заголовки событий файла по порядку, want - их время в формате документа
+		headers []string
+		want    []string
+	}{
+		{
+			name:     "utc",
+			fileDate: "24010203",
+			loc:      time.UTC,
+			headers:  []string{"04:05.000001"},
+			want:     []string{"2024-01-02T03:04:05.000001Z"},
+		},
+		{
+			name:     "winter offset",
+			fileDate: "24010203",
+			loc:      berlin,
+			headers:  []string{"04:05.000001"},
+			want:     []string{"2024-01-02T03:04:05.000001+01:00"},
+		},
+		{
+			name:     "summer offset",
+			fileDate: "24070203",
+			loc:      berlin,
+			headers:  []string{"04:05.000001"},
+			want:     []string{"2024-07-02T03:04:05.000001+02:00"},
+		},
+		{
+			name:     "repeated hour is written twice to one file",
+			fileDate: "23102902",
+			loc:      berlin,
+			headers:  []string{"10:00.000000", "50:00.000000", "05:00.000000", "20:00.000000"},
+			want: []string{
+				"2023-10-29T02:10:00.000000+02:00",
+				"2023-10-29T02:50:00.000000+02:00",
+				"2023-10-29T02:05:00.000000+01:00",
+				"2023-10-29T02:20:00.000000+01:00",
+			},
+		},
+		{
+			name:     "repeated hour resumed in second pass",
+			fileDate: "23102902",
+			loc:      berlin,
+			state:    hourState{Fold: true, Last: int64(5 * time.Minute)},
+			headers:  []string{"20:00.000000"},
+			want:     []string{"2023-10-29T02:20:00.000000+01:00"},
+		},
+		{
+			name:     "small step back is not a second pass",
+			fileDate: "23102902",
+			loc:      berlin,
+			headers:  []string{"10:00.500000", "10:00.100000"},
+			want:     []string{"2023-10-29T02:10:00.500000+02:00", "2023-10-29T02:10:00.100000+02:00"},
+		},
+		{
+			name:     "skipped hour uses offset before transition",
+			fileDate: "23032602",
+			loc:      berlin,
+			headers:  []string{"30:00.000000"},
+			want:     []string{"2023-03-26T03:30:00.000000+02:00"},
+		},
+	}
+
+	for _, tt := range tests {
+		clock := newEventClock(tt.fileDate, tt.loc, tt.state)
+		for i, header := range tt.headers {
+			offset, _, err := parseEventHeader(header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := clock.time(offset).Format(eventDateFormat); got != tt.want[i] {
+				t.Errorf("%s: %s: %s, want %s", tt.name, header, got, tt.want[i])
+			}
+		}
+	}
+
+	if clock := newEventClock("garbage", time.UTC, hourState{}); !clock.time(0).IsZero() || !clock.hourEnded(time.Now()) {
+		t.Errorf("invalid file date gives a time")
+	}
+}
+
+func TestNumericDuplicates(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		duplicates string
+		header     string
+		body       string
+		want       string
+		duration   int64
+	}{
+		{"array", "array", "04:05.000001", "10,DBMSSQL,1,Rows=3,Rows=4,Rows=5",
+			"duration=int64(10) rows=[]int64([3 4 5])", 10},
+		{"suffix", "suffix", "04:05.000001", "10,DBMSSQL,1,Rows=3,Rows=4,Rows=5",
+			"duration=int64(10) rows=int64(3) rows_2=int64(4) rows_3=int64(5)", 10},
+		{"array with text stays text", "array", "04:05.000001", "10,DBMSSQL,1,Rows=3,Rows=x",
+			"duration=int64(10) rows=[]string([3 x])", 10},
+		{"repeated duration in 8.2 units", "array", "04:05.0001", "10,CALL,1,Duration=20",
+			"duration=[]int64([1000 2000])", 1000},
+		{"suffix of text property", "suffix", "04:05.000001", "10,CALL,1,Usr=1,Usr=2",
+			"duration=int64(10) usr=string(1) usr_2=string(2)", 10},
+	}
+
+	for _, tt := range tests {
+		config := &conf{Path: "logs", DuplicateProperties: tt.duplicates}
+		event := parseTestEvent(t, config, &rawEvent{Header: tt.header, Body: tt.body}, nil)
+
+		var fields []string
+		for name, value := range event.Fields {
+			if name == "duration" || strings.HasPrefix(name, "rows") || strings.HasPrefix(name, "usr") {
+				fields = append(fields, fmt.Sprintf("%s=%T(%v)", name, value, value))
+			}
+		}
+		sort.Strings(fields)
+		if got := strings.Join(fields, " "); got != tt.want || event.Duration != tt.duration {
+			t.Errorf("%s:\n got %s, duration %d\nwant %s, duration %d", tt.name, got, event.Duration, tt.want, tt.duration)
+		}
+	}
+}
+
+func TestDuplicateProperties(t *testing.T) {
+
+	multiValued := getMultiValuedFields(map[string]string{
+		"tlock": `{"mappings": {"_meta": {"multi_valued": ["Locks"]}, "properties": {}}}`,
+	})
+	body := "10,TLOCK,1,Locks='InfoRg1.DIMS Exclusive',Context='А : 1',Context='Б : 2',Context='В : 3',Usr=Иванов"
+
+	tests := []struct {
+		duplicates string
+		body       string
+		want       string
+	}{
+		{"array", body,
+			"context=[]string(['А : 1' 'Б : 2' 'В : 3']) locks=[]string(['InfoRg1.DIMS Exclusive']) usr=string(Иванов)"},
+		{"suffix", body,
+			"context=string('А : 1') context_2=string('Б : 2') context_3=string('В : 3') locks=[]string(['InfoRg1.DIMS Exclusive']) usr=string(Иванов)"},
+		// повтор свойства, объявленного многозначным, остается в массиве и с суффиксами
+		{"suffix", "10,TLOCK,1,Locks='a',Locks='b'", "locks=[]string(['a' 'b'])"},
+		// многозначные поля объявляются для своего события
+		{"array", "10,CALL,1,Locks='a'", "locks=string('a')"},
+	}
+
+	for _, tt := range tests {
+		config := &conf{Path: "logs", DuplicateProperties: tt.duplicates}
+		event := parseTestEvent(t, config, &rawEvent{Header: "04:05.000001", Body: tt.body}, multiValued)
+
+		var fields []string
+		for name, value := range event.Fields {
+			if strings.HasPrefix(name, "context") || strings.HasPrefix(name, "locks") || name == "usr" {
+				fields = append(fields, fmt.Sprintf("%s=%T(%v)", name, value, value))
+			}
+		}
+		sort.Strings(fields)
+		if got := strings.Join(fields, " "); got != tt.want {
+			t.Errorf("%s %s:\n got %s\nwant %s", tt.duplicates, tt.body, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// getFileID возвращает идентификатор файла: устройство и inode
+func getFileID(file *os.File) string {
+	info, err := file.Stat()
+	if err != nil {
+		return ""
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("%v:%v", stat.Dev, stat.Ino)
+}
@@ -0,0 +1,19 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// getFileID возвращает идентификатор файла: серийный номер тома и индекс файла NTFS
+func getFileID(file *os.File) string {
+	var info syscall.ByHandleFileInformation
+	if err := syscall.GetFileInformationByHandle(syscall.Handle(file.Fd()), &info); err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%x:%x%08x", info.VolumeSerialNumber, info.FileIndexHigh, info.FileIndexLow)
+}
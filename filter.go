@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"strconv"
+)
+
+// действия правил отбора событий
+const (
+	filterInclude = "include"
+	filterExclude = "exclude"
+	filterSample  = "sample"
+)
+
+// filterConf правило отбора событий перед отправкой. Условия правила объединяются по И,
+// незаданные условия не проверяются. Правила проверяются по порядку, действует первое подошедшее,
+// событие, которому не подошло ни одно правило, отправляется.
+type filterConf struct {
+	// Action include - отправить, exclude - отбросить, sample - отправить долю rate событий
+	Action string `yaml:"action"`
+	// Events регулярное выражение имени события: CALL, SCALL|CONN
+	Events string `yaml:"events"`
+	// Properties регулярные выражения значений свойств, для массивов достаточно совпадения одного значения
+	Properties map[string]string `yaml:"properties"`
+	// MinDuration и MaxDuration границы длительности в микросекундах: min_duration <= duration < max_duration
+	MinDuration int64 `yaml:"min_duration"`
+	MaxDuration int64 `yaml:"max_duration"`
+	// Rate доля отправляемых событий для action: sample, от 0 до 1
+	Rate float64 `yaml:"rate"`
+}
+
+// eventFilter разобранное правило отбора
+type eventFilter struct {
+	filterConf
+	reEvents   *regexp.Regexp
+	properties map[string]*regexp.Regexp
+}
+
+// newEventFilters проверяет и разбирает правила отбора
+func newEventFilters(confs []filterConf) ([]*eventFilter, error) {
+
+	var filters []*eventFilter
+	for i, fc := range confs {
+
+		filter := &eventFilter{filterConf: fc}
+
+		switch fc.Action {
+		case filterInclude, filterExclude:
+		case filterSample:
+			if fc.Rate < 0 || fc.Rate > 1 {
+				return nil, fmt.Errorf("filter %d: rate must be between 0 and 1", i+1)
+			}
+		default:
+			return nil, fmt.Errorf("filter %d: unknown action %q", i+1, fc.Action)
+		}
+
+		if fc.Events != "" {
+			re, err := regexp.Compile(fmt.Sprintf("(?i)^(%s)$", fc.Events))
+			if err != nil {
+				return nil, fmt.Errorf("filter %d: events: %v", i+1, err)
+			}
+			filter.reEvents = re
+		}
+
+		if len(fc.Properties) > 0 {
+			filter.properties = make(map[string]*regexp.Regexp, len(fc.Properties))
+			for name, expr := range fc.Properties {
+				re, err := regexp.Compile(expr)
+				if err != nil {
+					return nil, fmt.Errorf("filter %d: property %s: %v", i+1, name, err)
+				}
+				filter.properties[name] = re
+			}
+		}
+
+		filters = append(filters, filter)
+	}
+	return filters, nil
+}
+
+// match проверяет условия правила
+func (f *eventFilter) match(event *techLogEvent) bool {
+
+	if f.reEvents != nil && !f.reEvents.MatchString(event.Name) {
+		return false
+	}
+	if f.MinDuration > 0 && event.Duration < f.MinDuration {
+		return false
+	}
+	if f.MaxDuration > 0 && event.Duration >= f.MaxDuration {
+		return false
+	}
+	for name, re := range f.properties {
+		name, _ = lookupField(event.Fields, name)
+		if !matchProperty(event.Fields[name], re) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchProperty проверяет значение свойства любого типа, отсутствующее свойство не подходит.
+// Строки проверяются без обрамляющих кавычек.
+func matchProperty(value interface{}, re *regexp.Regexp) bool {
+	switch value := value.(type) {
+	case int64:
+		return re.MatchString(strconv.FormatInt(value, 10))
+	case []int64:
+		for _, number := range value {
+			if re.MatchString(strconv.FormatInt(number, 10)) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, v := range unquoteValues(value) {
+		if re.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptEvent применяет правила отбора к событию. Выборка детерминирована: решение зависит только
+// от ключа события (файл и смещение), поэтому при повторном чтении файла отбираются те же события.
+func acceptEvent(filters []*eventFilter, event *techLogEvent, key string) bool {
+
+	for _, filter := range filters {
+		if !filter.match(event) {
+			continue
+		}
+		switch filter.Action {
+		case filterExclude:
+			return false
+		case filterSample:
+			return sampleKey(key) < filter.Rate
+		default:
+			return true
+		}
+	}
+	return true
+}
+
+// sampleKey отображает ключ события в число из [0, 1)
+func sampleKey(key string) float64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+	return float64(hash.Sum64()>>11) / float64(1<<53)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestAcceptEvent(t *testing.T) {
+
+	call := &techLogEvent{Name: "CALL", Duration: 5000, Fields: map[string]interface{}{
+		"p_processname": "base",
+		"usr":           []string{"Иванов", "Петров"},
+		"memory":        int64(1024),
+	}}
+	conn := &techLogEvent{Name: "CONN", Duration: 10, Fields: map[string]interface{}{}}
+
+	tests := []struct {
+		name    string
+		filters []filterConf
+		event   *techLogEvent
+		want    bool
+	}{
+		{"no rules", nil, call, true},
+		{"exclude by name", []filterConf{{Action: filterExclude, Events: "conn|scall"}}, conn, false},
+		{"exclude other name", []filterConf{{Action: filterExclude, Events: "CONN"}}, call, true},
+		{"first matching rule wins", []filterConf{
+			{Action: filterInclude, Events: "CALL"},
+			{Action: filterExclude},
+		}, call, true},
+		{"rule without conditions matches all", []filterConf{
+			{Action: filterInclude, Events: "CALL"},
+			{Action: filterExclude},
+		}, conn, false},
+		{"below min duration", []filterConf{{Action: filterExclude, MaxDuration: 1000}}, conn, false},
+		{"min duration is inclusive", []filterConf{{Action: filterExclude, MinDuration: 5000}}, call, false},
+		{"max duration is exclusive", []filterConf{{Action: filterExclude, MaxDuration: 5000}}, call, true},
+		{"property of array matches any value", []filterConf{
+			{Action: filterExclude, Properties: map[string]string{"usr": "^Петров$"}},
+		}, call, false},
+		{"numeric property", []filterConf{
+			{Action: filterExclude, Properties: map[string]string{"memory": "^10"}},
+		}, call, false},
+		{"missing property does not match", []filterConf{
+			{Action: filterExclude, Properties: map[string]string{"usr": "."}},
+		}, conn, true},
+		{"conditions are combined with and", []filterConf{
+			{Action: filterExclude, Events: "CALL", Properties: map[string]string{"p_processname": "^other$"}},
+		}, call, true},
+		{"sample rate 0", []filterConf{{Action: filterSample, Events: "CALL", Rate: 0}}, call, false},
+		{"sample rate 1", []filterConf{{Action: filterSample, Events: "CALL", Rate: 1}}, call, true},
+	}
+
+	for _, tt := range tests {
+		filters, err := newEventFilters(tt.filters)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := acceptEvent(filters, tt.event, "a.log:0"); got != tt.want {
+			t.Errorf("%s: accept %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNewEventFiltersErrors(t *testing.T) {
+
+	tests := []filterConf{
+		{Action: "drop"},
+		{Action: filterSample, Rate: 1.5},
+		{Action: filterSample, Rate: -0.1},
+		{Action: filterExclude, Events: "CALL("},
+		{Action: filterExclude, Properties: map[string]string{"usr": "["}},
+	}
+	for _, fc := range tests {
+		if _, err := newEventFilters([]filterConf{fc}); err == nil {
+			t.Errorf("%+v: no error", fc)
+		}
+	}
+}
+
+func TestAcceptEventSampling(t *testing.T) {
+
+	filters, err := newEventFilters([]filterConf{{Action: filterSample, Rate: 0.25}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := &techLogEvent{Name: "CALL", Fields: map[string]interface{}{}}
+
+	accepted := 0
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("rphost_1/24010203.log:%d", i*120)
+		decision := acceptEvent(filters, event, key)
+		// решение зависит только от ключа: при повторном чтении отбираются те же события
+		if acceptEvent(filters, event, key) != decision {
+			t.Fatalf("%s: decision changed", key)
+		}
+		if decision {
+			accepted++
+		}
+	}
+	if accepted < 2300 || accepted > 2700 {
+		t.Errorf("accepted %d of 10000 with rate 0.25", accepted)
+	}
+}
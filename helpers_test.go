@@ -0,0 +1,119 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Общие заготовки тестов: разбор событий, настройки приемников, поддельные серверы, приемники и архивы.
+
+// testLogFile файл тех журнала, относительно каталога источника тестовых настроек
+var testLogFile = filepath.Join("rphost_1", "24010203.log")
+
+// parseTestEvent разбирает событие raw файла rphost_1/24010203.log первого источника настроек config
+// так же, как при чтении каталога тех журнала
+func parseTestEvent(t *testing.T, config *conf, raw *rawEvent, multiValued map[string]map[string]bool) *techLogEvent {
+
+	if config.sources == nil {
+		if err := config.initSources(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	source := config.sources[0]
+	file := files{Path: filepath.Join(source.Path, testLogFile), Source: source}
+	info, ok := source.pathPattern.matchFile(source.Path, file)
+	if !ok {
+		t.Fatalf("%s does not match path_pattern", file.Path)
+	}
+	file.FileDate = info.FileDate
+	file.ProcessNameID = info.processNameID()
+	file.ProcessName = info.Process
+	file.ProcessID = info.PID
+	return parseEvent(raw, file, newEventClock(file.FileDate, source.location, hourState{}), config, multiValued)
+}
+
+// newTestConfig настройки с приемниками outputs, отклоненные документы сохраняются в файл dead_letter
+func newTestConfig(t *testing.T, outputs ...outputConf) *conf {
+
+	config := &conf{
+		DeadLetter:     deadLetterFile,
+		DeadLetterFile: filepath.Join(t.TempDir(), "deadletter.ndjson"),
+		Outputs:        outputs,
+	}
+	if err := config.initOutputs(); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.initDeadLetters(); err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+// newTestServer поддельный HTTP сервер, закрывается по завершении теста
+func newTestServer(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// testOutput приемник теста: запоминает принятые документы, при ошибке err на flush пакет теряется
+type testOutput struct {
+	pending []string
+	sent    []string
+	err     error
+}
+
+func (o *testOutput) send(event *outputEvent) error {
+	o.pending = append(o.pending, event.ID)
+	return nil
+}
+
+func (o *testOutput) flush() error {
+	if o.err != nil {
+		o.pending = nil
+		return o.err
+	}
+	o.sent = append(o.sent, o.pending...)
+	o.pending = nil
+	return nil
+}
+
+// newTestFanOut рассылка по приемникам outputs в порядке names
+func newTestFanOut(outputs map[string]*testOutput, names ...string) *outputFanOut {
+	fanOut := &outputFanOut{config: &conf{}}
+	for _, name := range names {
+		fanOut.outputs = append(fanOut.outputs, &fanOutput{
+			oc:  outputConf{Type: outputFile, Name: name, Path: "unused"},
+			out: outputs[name],
+		})
+	}
+	return fanOut
+}
+
+// writeTestZip архив с файлами rphost_<i>/24010203.log, содержимое файла - prefix и номер файла
+func writeTestZip(t *testing.T, path string, count int, prefix string) {
+
+	out, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := zip.NewWriter(out)
+	for i := 1; i <= count; i++ {
+		f, err := w.Create(fmt.Sprintf("rphost_%d/24010203.log", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(f, "%s %d\n", prefix, i)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"strings"
+)
+
+// property свойство события тех журнала
+type property struct {
+	Name  string
+	Value string
+}
+
+// имена позиционных свойств в начале события: duration,EVENT,level,...
+var positionalProperties = []string{"duration", "event_techlog", "stack"}
+
+// getPropertyName приводит имя свойства тех журнала к имени поля: t:connectID -> t_connectid
+func getPropertyName(key string) string {
+	name := strings.ToLower(key)
+	return strings.Replace(strings.Replace(name, ":", "_", 1), "-", "_", 1)
+}
+
+// состояния разбора текста события
+const (
+	// lexName имя свойства или значение без имени, до '=' или ','
+	lexName = iota
+	// lexValueStart первый символ значения после '='
+	lexValueStart
+	// lexValue значение без кавычек или текст после закрывающей кавычки, до ','
+	lexValue
+	// lexQuoted значение в кавычках
+	lexQuoted
+	// lexQuoteEnd кавычка внутри значения: закрывающая или первая из удвоенных
+	lexQuoteEnd
+)
+
+// lexState состояние разбора текста события по правилам кавычек 1С. Значение в кавычках начинается
+// только первым символом значения после '=', кавычка того же вида внутри значения экранируется удвоением.
+// Одно состояние используется и разбором свойств, и поиском границ событий при чтении файла,
+// поэтому они не расходятся в том, где заканчивается значение в кавычках.
+type lexState struct {
+	state int
+	quote byte
+}
+
+// step переводит разбор на символ c, true - символ ',' разделяет свойства
+func (s *lexState) step(c byte) bool {
+
+	switch s.state {
+	case lexName:
+		if c == '=' {
+			s.state = lexValueStart
+		}
+		return c == ','
+	case lexValueStart:
+		switch c {
+		case '\'', '"':
+			s.state, s.quote = lexQuoted, c
+		case ',':
+			s.state = lexName
+			return true
+		default:
+			s.state = lexValue
+		}
+	case lexValue:
+		if c == ',' {
+			s.state = lexName
+			return true
+		}
+	case lexQuoted:
+		if c == s.quote {
+			s.state = lexQuoteEnd
+		}
+	case lexQuoteEnd:
+		switch c {
+		case s.quote:
+			s.state = lexQuoted
+		case ',':
+			s.state = lexName
+			return true
+		default:
+			s.state = lexValue
+		}
+	}
+	return false
+}
+
+// scan переводит разбор на текст data
+func (s *lexState) scan(data []byte) {
+	for _, c := range data {
+		s.step(c)
+	}
+}
+
+// closed текст разобран не внутри значения в кавычках
+func (s *lexState) closed() bool {
+	return s.state != lexQuoted
+}
+
+// lexEvent разбирает текст события после заголовка: duration,EVENT,level,Key=Value,...
+//
+// Значение свойства может быть заключено в одинарные или двойные кавычки, тогда внутри допускаются
+// запятые, знаки '=' и переводы строк, а кавычка того же вида внутри значения экранируется удвоением.
+// Значение без кавычек продолжается до следующей запятой и тоже может содержать '='.
+// Значения возвращаются байт в байт как в файле, вместе с кавычками, раскрывает их unquoteValue.
+func lexEvent(body string) []property {
+
+	var props []property
+	var lex lexState
+	positional := 0
+	start, eq := 0, -1
+
+	emit := func(end int) {
+		if eq < 0 {
+			// значение без имени
+			name := "unclassified"
+			if positional < len(positionalProperties) {
+				name = positionalProperties[positional]
+			}
+			positional++
+			props = append(props, property{Name: name, Value: body[start:end]})
+		} else {
+			props = append(props, property{Name: getPropertyName(body[start:eq]), Value: body[eq+1 : end]})
+		}
+	}
+
+	for i := 0; i < len(body); i++ {
+		if lex.state == lexName && body[i] == '=' {
+			eq = i
+		}
+		if lex.step(body[i]) {
+			emit(i)
+			start, eq = i+1, -1
+		}
+	}
+	// запятая в конце текста не начинает пустое свойство
+	if start < len(body) {
+		emit(len(body))
+	}
+
+	return props
+}
+
+// unquoteValue значение свойства без обрамляющих кавычек и с раскрытым экранированием удвоением.
+// Текст после закрывающей кавычки относится к значению, незакрытая кавычка - значение до конца текста.
+// Значение без кавычек возвращается как есть.
+func unquoteValue(value string) string {
+
+	if value == "" || (value[0] != '\'' && value[0] != '"') {
+		return value
+	}
+	quote := value[0]
+
+	var sb strings.Builder
+	for i := 1; i < len(value); {
+		j := strings.IndexByte(value[i:], quote)
+		if j < 0 {
+			sb.WriteString(value[i:])
+			break
+		}
+		sb.WriteString(value[i : i+j])
+		i += j + 1
+		if i < len(value) && value[i] == quote {
+			// удвоенная кавычка - экранирование
+			sb.WriteByte(quote)
+			i++
+			continue
+		}
+		sb.WriteString(value[i:])
+		break
+	}
+	return sb.String()
+}
+
+// unquoteValues значения свойства любого типа без кавычек: строка или массив строк
+func unquoteValues(value interface{}) []string {
+	switch value := value.(type) {
+	case string:
+		return []string{unquoteValue(value)}
+	case []string:
+		values := make([]string, len(value))
+		for i, v := range value {
+			values[i] = unquoteValue(v)
+		}
+		return values
+	}
+	return nil
+}
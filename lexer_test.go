@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLexEvent(t *testing.T) {
+
+	tests := []struct {
+		name string
+		body string
+		want []property
+	}{
+		{
+			name: "positional properties",
+			body: "1,CALL,1,t:connectID=5",
+			want: []property{{"duration", "1"}, {"event_techlog", "CALL"}, {"stack", "1"}, {"t_connectid", "5"}},
+		},
+		{
+			name: "commas and '=' inside quotes",
+			body: "1,DBMSSQL,2,Sql='SELECT a, b FROM T WHERE c = 1',Rows=3",
+			want: []property{{"duration", "1"}, {"event_techlog", "DBMSSQL"}, {"stack", "2"},
+				{"sql", "'SELECT a, b FROM T WHERE c = 1'"}, {"rows", "3"}},
+		},
+		{
+			name: "double quotes and doubled quote escape",
+			body: `1,EXCP,0,Descr="Поле ""Сумма"", не заполнено"`,
+			want: []property{{"duration", "1"}, {"event_techlog", "EXCP"}, {"stack", "0"},
+				{"descr", `"Поле ""Сумма"", не заполнено"`}},
+		},
+		{
+			name: "single quote escape and other quote inside",
+			body: `1,EXCP,0,Descr='it''s "quoted"'`,
+			want: []property{{"duration", "1"}, {"event_techlog", "EXCP"}, {"stack", "0"},
+				{"descr", `'it''s "quoted"'`}},
+		},
+		{
+			name: "newlines inside quotes",
+			body: "1,CALL,1,Context='Форма.Записать\n\tМодуль : 12, Строка',Memory=10",
+			want: []property{{"duration", "1"}, {"event_techlog", "CALL"}, {"stack", "1"},
+				{"context", "'Форма.Записать\n\tМодуль : 12, Строка'"}, {"memory", "10"}},
+		},
+		{
+			name: "'=' in unquoted value",
+			body: "1,SCALL,1,ClientID=a=b,Method=0",
+			want: []property{{"duration", "1"}, {"event_techlog", "SCALL"}, {"stack", "1"},
+				{"clientid", "a=b"}, {"method", "0"}},
+		},
+		{
+			name: "empty values",
+			body: "1,CONN,0,Txt=,Usr=''",
+			want: []property{{"duration", "1"}, {"event_techlog", "CONN"}, {"stack", "0"},
+				{"txt", ""}, {"usr", "''"}},
+		},
+		{
+			name: "text after closing quote",
+			body: "1,EXCP,0,Descr='a'b,X=1",
+			want: []property{{"duration", "1"}, {"event_techlog", "EXCP"}, {"stack", "0"},
+				{"descr", "'a'b"}, {"x", "1"}},
+		},
+		{
+			name: "quote is not closed",
+			body: "1,EXCP,0,Descr='a,b",
+			want: []property{{"duration", "1"}, {"event_techlog", "EXCP"}, {"stack", "0"},
+				{"descr", "'a,b"}},
+		},
+		{
+			name: "extra value without name",
+			body: "1,EXCP,0,lost,X=1",
+			want: []property{{"duration", "1"}, {"event_techlog", "EXCP"}, {"stack", "0"},
+				{"unclassified", "lost"}, {"x", "1"}},
+		},
+		{
+			name: "trailing comma",
+			body: "1,CALL,1,Memory=10,",
+			want: []property{{"duration", "1"}, {"event_techlog", "CALL"}, {"stack", "1"}, {"memory", "10"}},
+		},
+		{
+			name: "empty value before trailing comma",
+			body: "1,CALL,1,,",
+			want: []property{{"duration", "1"}, {"event_techlog", "CALL"}, {"stack", "1"}, {"unclassified", ""}},
+		},
+		{
+			name: "quote inside unquoted value does not start quoting",
+			body: "1,EXCP,0,Descr=a='b,X=1",
+			want: []property{{"duration", "1"}, {"event_techlog", "EXCP"}, {"stack", "0"},
+				{"descr", "a='b"}, {"x", "1"}},
+		},
+		{
+			name: "property with dash",
+			body: "1,ATTN,0,Agent-Addr=srv",
+			want: []property{{"duration", "1"}, {"event_techlog", "ATTN"}, {"stack", "0"},
+				{"agent_addr", "srv"}},
+		},
+	}
+
+	for _, tt := range tests {
+		if got := lexEvent(tt.body); fmt.Sprintf("%q", got) != fmt.Sprintf("%q", tt.want) {
+			t.Errorf("%s:\n got %q\nwant %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUnquoteValue(t *testing.T) {
+
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"", ""},
+		{"plain", "plain"},
+		{"a='b", "a='b"},
+		{"''", ""},
+		{"'SELECT a, b'", "SELECT a, b"},
+		{`"Поле ""Сумма"""`, `Поле "Сумма"`},
+		{`'it''s "quoted"'`, `it's "quoted"`},
+		{"'a'b", "ab"},
+		{"'a,b", "a,b"},
+		{"'line\nnext'", "line\nnext"},
+	}
+
+	for _, tt := range tests {
+		if got := unquoteValue(tt.value); got != tt.want {
+			t.Errorf("%q: %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
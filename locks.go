@@ -0,0 +1,482 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// сколько последних блокировок соединения хранится для поиска виновника ожидания
+const lockHistorySize = 32
+
+// сколько хранятся блокировки соединения, если соединение больше не блокирует, по времени событий
+const lockHistoryAge = time.Hour
+
+// lockField поле пространства блокировки и его значение: Fld124=1:8b6e
+type lockField struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// lockRecord блокировка одного пространства из свойства Locks: InfoRg123.DIMS Exclusive Fld124=1:8b6e
+type lockRecord struct {
+	Space  string      `json:"space"`
+	Mode   string      `json:"mode"`
+	Fields []lockField `json:"fields,omitempty"`
+}
+
+// deadlockEdge ребро графа взаимоблокировки: соединение waiter ждет соединение holder
+type deadlockEdge struct {
+	Waiter string     `json:"waiter"`
+	Holder string     `json:"holder"`
+	Lock   lockRecord `json:"lock"`
+}
+
+// splitOutsideQuotes делит текст по разделителю sep вне значений в двойных кавычках
+func splitOutsideQuotes(text string, sep func(byte) bool) []string {
+
+	var parts []string
+	quoted := false
+	start := 0
+	for i := 0; i < len(text); i++ {
+		switch {
+		case text[i] == '"':
+			quoted = !quoted
+		case !quoted && sep(text[i]):
+			parts = append(parts, text[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, text[start:])
+}
+
+// parseLockTokens разбирает блокировку из слов: пространство, режим, поля
+func parseLockTokens(tokens []string) (lockRecord, bool) {
+
+	var record lockRecord
+	var words []string
+	for _, token := range tokens {
+		if token != "" {
+			words = append(words, token)
+		}
+	}
+	if len(words) < 2 {
+		return record, false
+	}
+
+	record.Space = words[0]
+	record.Mode = words[1]
+	for _, word := range words[2:] {
+		eq := strings.IndexByte(word, '=')
+		if eq < 0 {
+			continue
+		}
+		value := word[eq+1:]
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = strings.ReplaceAll(value[1:len(value)-1], `""`, `"`)
+		}
+		record.Fields = append(record.Fields, lockField{Name: word[:eq], Value: value})
+	}
+	return record, true
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+func isComma(c byte) bool {
+	return c == ','
+}
+
+// parseLocks разбирает свойство Locks: блокировки пространств через запятую,
+// в каждой - пространство, режим и значения полей через пробел
+func parseLocks(locks string) []lockRecord {
+
+	var records []lockRecord
+	for _, part := range splitOutsideQuotes(locks, isComma) {
+		if record, ok := parseLockTokens(splitOutsideQuotes(strings.TrimSpace(part), isSpace)); ok {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+// parseDeadlockIntersections разбирает свойство DeadlockConnectionIntersections:
+// через запятую пары "ждущее_соединение соединение_владелец пространство режим поля"
+func parseDeadlockIntersections(text string) []deadlockEdge {
+
+	var edges []deadlockEdge
+	for _, part := range splitOutsideQuotes(text, isComma) {
+		tokens := splitOutsideQuotes(strings.TrimSpace(part), isSpace)
+		if len(tokens) < 4 {
+			continue
+		}
+		record, ok := parseLockTokens(tokens[2:])
+		if !ok {
+			continue
+		}
+		edges = append(edges, deadlockEdge{Waiter: tokens[0], Holder: tokens[1], Lock: record})
+	}
+	return edges
+}
+
+// deadlockCycle восстанавливает цикл ожидания по ребрам графа: 8 -> 7 -> 8
+func deadlockCycle(edges []deadlockEdge) []string {
+
+	next := make(map[string]string)
+	for _, edge := range edges {
+		if _, ok := next[edge.Waiter]; !ok {
+			next[edge.Waiter] = edge.Holder
+		}
+	}
+	if len(edges) == 0 {
+		return nil
+	}
+
+	// идем от первого ждущего соединения, пока не встретим уже пройденное
+	visited := make(map[string]int)
+	var path []string
+	for conn := edges[0].Waiter; conn != ""; conn = next[conn] {
+		if i, ok := visited[conn]; ok {
+			return append(path[i:], conn)
+		}
+		visited[conn] = len(path)
+		path = append(path, conn)
+	}
+	return nil
+}
+
+// getEventValues возвращает значения свойства события строками без кавычек
+func getEventValues(event *techLogEvent, name string) []string {
+	return unquoteValues(event.Fields[name])
+}
+
+// parseWaitConnections разбирает список соединений WaitConnections
+func parseWaitConnections(event *techLogEvent) []string {
+	var conns []string
+	for _, value := range getEventValues(event, "waitconnections") {
+		for _, conn := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }) {
+			conns = append(conns, conn)
+		}
+	}
+	return conns
+}
+
+// lockEvent блокировка, установленная соединением
+type lockEvent struct {
+	Time    time.Time
+	DocID   string
+	File    string
+	Usr     string
+	Context interface{}
+	Locks   []lockRecord
+}
+
+// lockWait ожидание блокировки: TLOCK с WaitConnections, TTIMEOUT или взаимоблокировка TDEADLOCK.
+// Свойства события запоминаются при разборе, до обработчиков полей, которые могут их изменить.
+type lockWait struct {
+	source   *logSource
+	file     files
+	docID    string
+	name     string
+	time     time.Time
+	duration int64
+	connect  string
+	usr      string
+	context  interface{}
+	locks    []lockRecord
+	infobase string
+	waits    []string
+	edges    []deadlockEdge
+}
+
+// lockAnalyzer разбирает блокировки и восстанавливает цепочки ожиданий.
+// Блокировки всех файлов прохода собираются по соединениям, ожидания разрешаются в конце прохода:
+// виновник ожидания может быть записан в файл другого процесса, который обрабатывается параллельно.
+type lockAnalyzer struct {
+	mu sync.Mutex
+	// history последние блокировки соединений по ключу информационная база/соединение
+	history map[string][]*lockEvent
+	waits   []*lockWait
+	latest  time.Time
+	// observed позиции файлов, до которых события уже учтены, по пути файла
+	observed map[string]observedFile
+}
+
+// observedFile позиция файла, до которой события учтены анализатором. Файл читается повторно
+// с сохраненной позиции, если приемник не принял документы, и повторно прочитанные ожидания
+// не должны создавать повторные документы LOCKCHAIN и DEADLOCK.
+type observedFile struct {
+	fileID   string
+	position int64
+	time     time.Time
+}
+
+func newLockAnalyzer() *lockAnalyzer {
+	return &lockAnalyzer{
+		history:  make(map[string][]*lockEvent),
+		observed: make(map[string]observedFile),
+	}
+}
+
+// observedPosition позиция файла, до которой события уже учтены: при текущей работе парсера
+// или при предыдущем чтении файла, после которого приемники приняли документы
+func (a *lockAnalyzer) observedPosition(file files) int64 {
+
+	position := file.Sent
+	for _, sent := range file.OutputsSent {
+		position = maxInt64(position, sent)
+	}
+	if observed, ok := a.observed[file.Path]; ok && observed.fileID == file.Identity.FileID {
+		position = maxInt64(position, observed.position)
+	}
+	return position
+}
+
+func lockConnectionKey(infobase string, conn string) string {
+	return infobase + "/" + conn
+}
+
+// observe добавляет к событиям блокировок разобранные поля и запоминает блокировки и ожидания
+func (a *lockAnalyzer) observe(file files, raw *rawEvent, event *techLogEvent) {
+
+	switch event.Name {
+	case "TLOCK", "TTIMEOUT", "TDEADLOCK":
+	default:
+		return
+	}
+
+	var records []lockRecord
+	for _, locks := range getEventValues(event, "locks") {
+		records = append(records, parseLocks(locks)...)
+	}
+	if len(records) > 0 {
+		event.Fields["locks_parsed"] = records
+	}
+
+	var edges []deadlockEdge
+	if event.Name == "TDEADLOCK" {
+		edges = parseDeadlockIntersections(unquoteValue(event.getString("deadlockconnectionintersections")))
+		if len(edges) > 0 {
+			event.Fields["deadlock_edges"] = edges
+			if cycle := deadlockCycle(edges); len(cycle) > 0 {
+				event.Fields["deadlock_cycle"] = cycle
+			}
+		}
+	}
+
+	infobase := event.getString("p_processname")
+	docID := raw.documentID(file.Path)
+	waits := parseWaitConnections(event)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if event.Time.After(a.latest) {
+		a.latest = event.Time
+	}
+
+	// событие прочитано повторно: поля разобраны заново для отправки, а блокировки и ожидания уже учтены
+	if raw.Start < a.observedPosition(file) {
+		return
+	}
+	a.observed[file.Path] = observedFile{fileID: file.Identity.FileID, position: raw.End, time: event.Time}
+
+	if event.Name == "TLOCK" && len(records) > 0 {
+		key := lockConnectionKey(infobase, event.getString("t_connectid"))
+		history := append(a.history[key], &lockEvent{
+			Time:    event.Time,
+			DocID:   docID,
+			File:    file.Path,
+			Usr:     event.getString("usr"),
+			Context: copyValue(event.Fields["context"]),
+			Locks:   records,
+		})
+		if len(history) > lockHistorySize {
+			history = history[len(history)-lockHistorySize:]
+		}
+		a.history[key] = history
+	}
+
+	if len(waits) > 0 || len(edges) > 0 {
+		a.waits = append(a.waits, &lockWait{
+			source:   file.Source,
+			file:     file,
+			docID:    docID,
+			name:     event.Name,
+			time:     event.Time,
+			duration: event.Duration,
+			connect:  event.getString("t_connectid"),
+			usr:      event.getString("usr"),
+			context:  copyValue(event.Fields["context"]),
+			locks:    records,
+			infobase: infobase,
+			waits:    waits,
+			edges:    edges,
+		})
+	}
+}
+
+// sameSpace проверяет, что блокировки пересекаются по пространству
+func sameSpace(a []lockRecord, b []lockRecord) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x.Space == y.Space {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// findCulprit ищет последнюю блокировку соединения conn до начала ожидания, предпочтительно
+// по тому же пространству, что и ожидаемая блокировка
+func (a *lockAnalyzer) findCulprit(infobase string, conn string, before time.Time, wanted []lockRecord) *lockEvent {
+
+	var found *lockEvent
+	history := a.history[lockConnectionKey(infobase, conn)]
+	for i := len(history) - 1; i >= 0; i-- {
+		lock := history[i]
+		if !before.IsZero() && lock.Time.After(before) {
+			continue
+		}
+		if len(wanted) == 0 || sameSpace(lock.Locks, wanted) {
+			return lock
+		}
+		if found == nil {
+			found = lock
+		}
+	}
+	return found
+}
+
+// derivedDocument производный документ анализа блокировок
+type derivedDocument struct {
+	Source *logSource
+	File   files
+	ID     string
+	Event  *techLogEvent
+}
+
+func derivedID(parts ...string) string {
+	hash := md5.Sum([]byte(strings.Join(parts, "\n")))
+	return hex.EncodeToString(hash[:])
+}
+
+// flush разрешает накопленные за проход ожидания в документы LOCKCHAIN (ожидание и его виновник)
+// и DEADLOCK (взаимоблокировка с участниками), устаревшие блокировки соединений забываются
+func (a *lockAnalyzer) flush() []*derivedDocument {
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var docs []*derivedDocument
+	for _, wait := range a.waits {
+		started := wait.time.Add(-time.Duration(wait.duration) * time.Microsecond)
+		wanted := wait.locks
+
+		for _, conn := range wait.waits {
+			fields := map[string]interface{}{
+				"event_techlog":     "LOCKCHAIN",
+				"wait_event":        wait.name,
+				"wait_duration":     wait.duration,
+				"victim_connectid":  wait.connect,
+				"victim_usr":        wait.usr,
+				"victim_event_id":   wait.docID,
+				"culprit_connectid": conn,
+				"culprit_found":     false,
+				"p_processname":     wait.infobase,
+				"processNameID":     wait.file.ProcessNameID,
+				"SourceFile":        wait.file.Path,
+			}
+			if wait.context != nil {
+				fields["victim_context"] = wait.context
+			}
+			if len(wanted) > 0 {
+				fields["locks_parsed"] = wanted
+			}
+			if culprit := a.findCulprit(wait.infobase, conn, started, wanted); culprit != nil {
+				fields["culprit_found"] = true
+				fields["culprit_usr"] = culprit.Usr
+				fields["culprit_event_id"] = culprit.DocID
+				fields["culprit_locks"] = culprit.Locks
+				fields["culprit_time"] = culprit.Time.Format(eventDateFormat)
+				fields["culprit_file"] = culprit.File
+				if culprit.Context != nil {
+					fields["culprit_context"] = culprit.Context
+				}
+			}
+			docs = append(docs, &derivedDocument{
+				Source: wait.source,
+				File:   wait.file,
+				ID:     derivedID(wait.docID, conn),
+				Event:  &techLogEvent{Time: wait.time, Name: "LOCKCHAIN", Duration: wait.duration, Fields: fields},
+			})
+		}
+
+		if len(wait.edges) > 0 {
+			var participants []map[string]interface{}
+			var conns []string
+			seen := make(map[string]bool)
+			for _, edge := range wait.edges {
+				for _, conn := range []string{edge.Waiter, edge.Holder} {
+					if !seen[conn] {
+						seen[conn] = true
+						conns = append(conns, conn)
+					}
+				}
+			}
+			sort.Strings(conns)
+			for _, conn := range conns {
+				participant := map[string]interface{}{"connectid": conn}
+				if lock := a.findCulprit(wait.infobase, conn, wait.time, nil); lock != nil {
+					participant["usr"] = lock.Usr
+					participant["event_id"] = lock.DocID
+					participant["locks"] = lock.Locks
+					if lock.Context != nil {
+						participant["context"] = lock.Context
+					}
+				}
+				participants = append(participants, participant)
+			}
+
+			fields := map[string]interface{}{
+				"event_techlog":   "DEADLOCK",
+				"deadlock_edges":  wait.edges,
+				"connections":     conns,
+				"participants":    participants,
+				"victim_event_id": wait.docID,
+				"p_processname":   wait.infobase,
+				"processNameID":   wait.file.ProcessNameID,
+				"SourceFile":      wait.file.Path,
+			}
+			if cycle := deadlockCycle(wait.edges); len(cycle) > 0 {
+				fields["deadlock_cycle"] = cycle
+			}
+			docs = append(docs, &derivedDocument{
+				Source: wait.source,
+				File:   wait.file,
+				ID:     derivedID(wait.docID, "deadlock"),
+				Event:  &techLogEvent{Time: wait.time, Name: "DEADLOCK", Fields: fields},
+			})
+		}
+	}
+	a.waits = nil
+
+	// забываем блокировки соединений, которые давно ничего не блокировали
+	for key, history := range a.history {
+		if len(history) == 0 || history[len(history)-1].Time.Before(a.latest.Add(-lockHistoryAge)) {
+			delete(a.history, key)
+		}
+	}
+	for path, observed := range a.observed {
+		if observed.time.Before(a.latest.Add(-lockHistoryAge)) {
+			delete(a.observed, path)
+		}
+	}
+
+	return docs
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// testLockWait событие TLOCK с ожиданием соединения 7
+const testLockWait = "1000,TLOCK,1,t:connectID=8,p:processName=base,Locks='InfoRg123.DIMS Exclusive Fld124=1',WaitConnections=7"
+
+func TestLockAnalyzerRereadEvents(t *testing.T) {
+
+	tests := []struct {
+		name string
+		file files
+		// starts смещения событий первого и повторного чтения файла
+		first  []int64
+		reread []int64
+		want   int
+	}{
+		{"new events", files{Path: "a.log"}, []int64{0}, []int64{100}, 2},
+		{"reread after failed flush", files{Path: "a.log"}, []int64{0, 100}, []int64{0, 100}, 2},
+		{"reread from saved position", files{Path: "a.log", Sent: 200}, nil, []int64{100, 200}, 1},
+		{"reread with output position", files{Path: "a.log", OutputsSent: map[string]int64{"webhook_2": 200}}, nil, []int64{100}, 0},
+	}
+
+	config := &conf{Path: "logs"}
+	for _, tt := range tests {
+		a := newLockAnalyzer()
+		docs := 0
+		for _, starts := range [][]int64{tt.first, tt.reread} {
+			for _, start := range starts {
+				raw := &rawEvent{Header: "04:05.000000", Body: testLockWait, Start: start, End: start + 100}
+				event := parseTestEvent(t, config, raw, nil)
+				a.observe(tt.file, raw, event)
+				if event.Fields["locks_parsed"] == nil {
+					t.Errorf("%s: locks are not parsed at %d", tt.name, start)
+				}
+			}
+			docs += len(a.flush())
+		}
+		if docs != tt.want {
+			t.Errorf("%s: %d LOCKCHAIN documents, want %d", tt.name, docs, tt.want)
+		}
+	}
+}
+
+func TestSendDerivedDocumentsDeadLetter(t *testing.T) {
+
+	var received []string
+	status := http.StatusServiceUnavailable
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if status == http.StatusOK {
+			received = append(received, strings.Split(strings.TrimSpace(string(body)), "\n")...)
+		}
+		w.WriteHeader(status)
+	})
+	config := newTestConfig(t, outputConf{Type: outputWebhook, Name: "hook", URL: server.URL})
+
+	a := newLockAnalyzer()
+	raw := &rawEvent{Header: "04:05.000000", Body: testLockWait, End: 100}
+	event := parseTestEvent(t, &conf{Path: "logs"}, raw, nil)
+	a.observe(files{Path: "a.log"}, raw, event)
+
+	// приемник недоступен - документ сохраняется в dead_letter
+	if err := sendDerivedDocuments(config, a.flush()); err != nil {
+		t.Fatal(err)
+	}
+	letters, err := readDeadLetters(config.DeadLetterFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 || letters[0].Output != "hook" || letters[0].Event != "LOCKCHAIN" || letters[0].Index != "" {
+		t.Fatalf("dead letters %+v", letters)
+	}
+
+	// повторная отправка передает документ тому же приемнику
+	status = http.StatusOK
+	rejected, err := resendDeadLetters(config, letters)
+	if err != nil || len(rejected) != 0 {
+		t.Fatalf("resend: %v, rejected %d", err, len(rejected))
+	}
+	if len(received) != 1 || received[0] != letters[0].Document {
+		t.Errorf("received %q", received)
+	}
+}
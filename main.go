@@ -1,13 +1,10 @@
 package main
 
 import (
-	"bytes"
-	"crypto/md5"
 	"crypto/tls"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"net"
@@ -22,8 +19,6 @@ import (
 	"time"
 
 	"github.com/elastic/go-elasticsearch/v8"
-	"github.com/elastic/go-elasticsearch/v8/esapi"
-	"github.com/gomodule/redigo/redis"
 	logr "github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v3"
 )
@@ -35,6 +30,7 @@ type conf struct {
 	RedisLogin                       string `yaml:"redis_login"`
 	RedisPassword                    string `yaml:"redis_password"`
 	RedisDatabase                    int    `yaml:"redis_database"`
+	RedisPrefix                      string `yaml:"redis_prefix"`
 	ElasticAddr                      string `yaml:"elastic_addr"`
 	ElasticLogin                     string `yaml:"elastic_login"`
 	ElasticPassword                  string `yaml:"elastic_password"`
@@ -52,7 +48,48 @@ type conf struct {
 	LogLifeSpan                      int    `yaml:"log_life_span"`
 	DeleteTabsInContexts             bool   `yaml:"delete_tabs_in_contexts"`
 	DeletePostfixInNameVirtualTables bool   `yaml:"delete_postfix_in_name_virtual_tables"`
+	DuplicateProperties              string `yaml:"duplicate_properties"`
 	InsecureSkipVerify               bool   `yaml:"skip_verify_certificates"`
+	CheckpointStore                  string `yaml:"checkpoint_store"`
+	CheckpointFile                   string `yaml:"checkpoint_file"`
+	InstanceID                       string `yaml:"instance_id"`
+	LockTTL                          int    `yaml:"lock_ttl"`
+	Daemon                           bool   `yaml:"daemon"`
+	DaemonWatch                      bool   `yaml:"daemon_watch"`
+	DaemonPollInterval               int    `yaml:"daemon_poll_interval"`
+	TimeZone                         string `yaml:"time_zone"`
+	PathPattern                      string `yaml:"path_pattern"`
+	NormalizeQueries                 bool   `yaml:"normalize_queries"`
+	SplitContext                     bool   `yaml:"split_context"`
+	CorrelateCalls                   bool   `yaml:"correlate_calls"`
+	CorrelateEvents                  string `yaml:"correlate_events"`
+	CorrelateWindow                  int    `yaml:"correlate_window"`
+	CorrelateMaxPending              int    `yaml:"correlate_max_pending"`
+	MaxEventSize                     int64  `yaml:"max_event_size"`
+	AnalyzeLocks                     bool   `yaml:"analyze_locks"`
+	DeadLetter                       string `yaml:"dead_letter"`
+	DeadLetterFile                   string `yaml:"dead_letter_file"`
+	DeadLetterIndex                  string `yaml:"dead_letter_index"`
+
+	// Sources каталоги тех журнала со своими настройками, без них - единственный каталог path
+	Sources []sourceConf `yaml:"sources"`
+	// Filters общие правила отбора событий перед отправкой
+	Filters []filterConf `yaml:"filters"`
+	// Processors общие обработчики полей событий: переименование, удаление, замена, маскирование
+	Processors []processorConf `yaml:"processors"`
+	// Outputs приемники событий, без них - Elasticsearch по параметрам elastic_*
+	Outputs []outputConf `yaml:"outputs"`
+
+	// sources источники тех журнала с разобранными настройками
+	sources []*logSource
+	// reCorrelate события, которые связываются с вызовом CALL
+	reCorrelate *regexp.Regexp
+	// outputs приемники событий с заполненными настройками
+	outputs []outputConf
+	// locks анализ блокировок, общий для всех файлов прохода
+	locks *lockAnalyzer
+	// deadLetters приемник документов, отклоненных Elasticsearch
+	deadLetters *deadLetterSink
 }
 
 type bulkResponse struct {
@@ -78,10 +115,22 @@ type files struct {
 	Path          string
 	Size          int64
 	LastPosition  int64
+	Identity      fileIdentity
 	FileDate      string
 	DataCreate    time.Time
 	ProcessNameID string
-	BlokingID     string
+	ProcessName   string
+	ProcessID     string
+	Source        *logSource
+	HourState     hourState
+	// Sent позиция, до которой события уже отправлены, если позиция файла удержана на ожидающих вызова событиях
+	Sent int64
+	// OutputsSent позиции, до которых события уже приняты отдельными приемниками, если другой приемник
+	// вернул ошибку и позиция файла удержана
+	OutputsSent map[string]int64
+	// Archive путь архива zip, Entry - путь файла в архиве, если файл тех журнала находится в архиве
+	Archive string
+	Entry   string
 }
 
 func (c *conf) getConfig() *conf {
@@ -98,24 +147,6 @@ func (c *conf) getConfig() *conf {
 	return c
 }
 
-// получаем дату время в формате jdata
-func getDateEvent(fileDate, word string) string {
-
-	year := fileDate[0:2]
-	month := fileDate[2:4]
-	day := fileDate[4:6]
-	minuts := fileDate[6:8]
-
-	dateEventArray := []string{"20", year, "-", month, "-", day, "T", minuts, ":", word}
-	buffer := bytes.Buffer{}
-
-	for _, val := range dateEventArray {
-		buffer.WriteString(val)
-	}
-
-	return buffer.String()
-}
-
 func track() time.Time {
 	return time.Now()
 }
@@ -127,82 +158,6 @@ func duration(start time.Time) {
 	}).Infof("Final time is: %v\n", time.Since(start))
 }
 
-func getFileParametersRedis(conn redis.Conn, idFile string) int64 {
-
-	valueTmpRedis, err := redis.String(conn.Do("GET", idFile))
-	if err != nil {
-		return 0
-	}
-
-	valueRedis, err := strconv.ParseInt(valueTmpRedis, 10, 64)
-	if err != nil {
-		return 0
-	}
-
-	return valueRedis
-}
-
-func setFileParametersRedis(conn redis.Conn, idFile string, pos int64) {
-
-	conn.Do("SET", idFile, strconv.FormatInt(pos, 10))
-}
-
-// удаление ключа в redis
-func deleteFileParametersRedis(conn redis.Conn, idFile string) {
-	conn.Do("DEL", idFile)
-}
-
-func getMapEvent(str *string) map[string]string {
-
-	var (
-		Value    string
-		Property string
-	)
-
-	strEvent := strings.Split(*str, ",")
-
-	paramets := make(map[string]string)
-	for idxStr, Event := range strEvent {
-
-		// поиск символа =
-		runeIndex := strings.Index(Event, "=")
-
-		if runeIndex > 0 {
-
-			PropertyTmp := strings.ToLower(Event[0:runeIndex])
-			Property = strings.Replace(strings.Replace(PropertyTmp, ":", "_", 1), "-", "_", 1)
-			ValueTmp := Event[runeIndex+1:]
-			Value = ValueTmp
-
-		} else {
-			Value = Event
-			switch idxStr {
-			case 0:
-				Property = "duration"
-			case 1:
-				Property = "event_techlog"
-			case 2:
-				Property = "stack"
-			default:
-				Property = "unclassified"
-			}
-		}
-
-		paramets[Property] = Value
-	}
-	return paramets
-}
-
-// заменяет заданные символы в строках, подходящих под регулярные выражения на новые символы
-func replaceGaps(str *string, exp string, old string, new string) {
-	regexGaps := regexp.MustCompile(exp)
-	gapsStrings := regexGaps.FindAllString(*str, -1)
-	for _, gapString := range gapsStrings {
-		rightStringTmp := strings.Replace(*str, gapString, strings.ReplaceAll(gapString, old, new), -1)
-		*str = rightStringTmp
-	}
-}
-
 func replaceSymbols(str *string, config *conf) {
 	if config.DeleteTabsInContexts {
 		*str = strings.ReplaceAll(*str, "\t", "")
@@ -221,19 +176,6 @@ func replaceSymbols(str *string, config *conf) {
 	}
 }
 
-// Reverse возвращает инвентированную строку
-func Reverse(s string) string {
-	r := []rune(s)
-	for i, j := 0, len(r)-1; i < len(r)/2; i, j = i+1, j-1 {
-		r[i], r[j] = r[j], r[i]
-	}
-	return string(r)
-}
-
-func isLetter(c rune) bool {
-	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
-}
-
 func getFilesPacked(arrFiles []*files, maxdop int) map[int][]files {
 
 	take := make(map[int][]files)
@@ -251,38 +193,11 @@ func getFilesPacked(arrFiles []*files, maxdop int) map[int][]files {
 	return take
 }
 
-func readFile(file files) ([]byte, int64, error) {
-
-	currPosition := file.LastPosition
-
-	openFile, err := os.Open(file.Path)
-	if err != nil {
-		return nil, 0, err
-	}
-
-	buffer := make([]byte, 64)
-	var data []byte
-
-	openFile.Seek(file.LastPosition, 0)
-
-	for {
-		n, err := openFile.Read(buffer)
-		currPosition += int64(n)
-		if err == io.EOF { // если конец файла
-			break // выходим из цикла
-		}
-		data = append(data, buffer[:n]...)
-	}
-
-	openFile.Close()
-	return data, currPosition, nil
-}
-
 // формирование наименование индекса по правилам, заданным в conf файле
-func getIndexName(config *conf) string {
+func getIndexName(template string) string {
 	today := time.Now()
 
-	str := strings.ReplaceAll(config.ElasticIndx, "yyyy", strconv.Itoa(today.Year()))
+	str := strings.ReplaceAll(template, "yyyy", strconv.Itoa(today.Year()))
 	str = strings.ReplaceAll(str, "MM", strconv.Itoa(int(today.Month())))
 	str = strings.ReplaceAll(str, "dd", strconv.Itoa(today.Day()))
 	str = strings.ReplaceAll(str, "hh", strconv.Itoa(today.Hour()))
@@ -308,7 +223,7 @@ func getMappings() map[string]string {
 	separator := string(os.PathSeparator)
 
 	for _, file := range files {
-		data, _, err := readFile(file)
+		data, err := ioutil.ReadFile(file.Path)
 		if err != nil {
 			logr.WithFields(logr.Fields{
 				"object": "Map file",
@@ -323,6 +238,39 @@ func getMappings() map[string]string {
 	return mapping
 }
 
+// getMultiValuedFields возвращает поля, объявленные в картах многозначными, по типам событий.
+// Объявление - секция _meta карты индекса: "_meta": { "multi_valued": ["locks"] }
+func getMultiValuedFields(mapping map[string]string) map[string]map[string]bool {
+
+	multiValued := make(map[string]map[string]bool)
+	for event, data := range mapping {
+
+		var m struct {
+			Mappings struct {
+				Meta struct {
+					MultiValued []string `json:"multi_valued"`
+				} `json:"_meta"`
+			} `json:"mappings"`
+		}
+		if err := json.Unmarshal([]byte(data), &m); err != nil {
+			logr.WithFields(logr.Fields{
+				"object": "Map file",
+				"title":  "Failure to parse map file",
+				"event":  event,
+			}).Warning(err)
+			continue
+		}
+
+		for _, field := range m.Mappings.Meta.MultiValued {
+			if multiValued[event] == nil {
+				multiValued[event] = make(map[string]bool)
+			}
+			multiValued[event][strings.ToLower(field)] = true
+		}
+	}
+	return multiValued
+}
+
 func createElasticsearchClient(config *conf) (*elasticsearch.Client, error) {
 
 	cfgElastic := elasticsearch.Config{
@@ -348,159 +296,214 @@ func createElasticsearchClient(config *conf) (*elasticsearch.Client, error) {
 	return es, err
 }
 
-func jobExtractTechLogs(filesInPackage []files, keyInPackage int, config *conf, c chan int) {
-
-	var (
-		rightString string
-		indexName   = getIndexName(config)
-		res         *esapi.Response
-		raw         map[string]interface{}
-		blk         *bulkResponse
-	)
-
-	// 1. подключаемся к эластичному
-	es, _ := createElasticsearchClient(config)
-
-	// 2. подключаемся к redis
-	conn, _ := redis.Dial("tcp", config.RedisAddr,
-		redis.DialUsername(config.RedisLogin),
-		redis.DialPassword(config.RedisPassword),
-		redis.DialDatabase(config.RedisDatabase),
-	)
-
-	defer conn.Close()
-
-	// 3. считываем мэппинг для индексов elastic из map файлов
-	mapping := getMappings()
-
-	// 4. работаем с файлами
-	RegExpEvents := fmt.Sprintf("(%s)=", config.TechLogDetailsEvents)
-	re := regexp.MustCompile("[0-9][0-9]:[0-9][0-9].[0-9]+-")
-	reContextstrings := regexp.MustCompile(RegExpEvents)
-
-	for _, file := range filesInPackage {
-
-		data, currentPosition, err := readFile(file)
-
-		if err != nil {
-			deleteFileParametersRedis(conn, file.BlokingID)
-			logr.WithFields(logr.Fields{
-				"object": "Data",
-				"title":  "Open file data",
-			}).Fatal(err)
+// разбор события тех журнала в типизированное событие.
+// К значениям свойств из tech_log_details_events источника (контексты, тексты запросов) применяются
+// настройки удаления табуляций и постфиксов временных таблиц, затем обработчики полей источника,
+// и только после них вычисляются производные поля.
+//
+// Свойство может повторяться в одном событии (несколько Locks, Context). Повторы сохраняются массивом
+// или полями с суффиксом номера повтора (locks_2, locks_3), в зависимости от duplicate_properties.
+// Поля, объявленные в карте события многозначными, всегда выводятся массивом.
+func parseEvent(event *rawEvent, file files, clock *eventClock, config *conf, multiValued map[string]map[string]bool) *techLogEvent {
+
+	props := lexEvent(event.Body)
+
+	var declared map[string]bool
+	for _, prop := range props {
+		if prop.Name == "event_techlog" {
+			declared = multiValued[strings.ToLower(prop.Value)]
+			break
 		}
+	}
 
-		if data == nil {
-			deleteFileParametersRedis(conn, file.BlokingID)
-			continue
+	paramets := make(map[string]interface{})
+	counts := make(map[string]int)
+	for _, prop := range props {
+		if file.Source.reDetails.MatchString(prop.Name) {
+			replaceSymbols(&prop.Value, config)
 		}
 
-		headings := re.FindAllString(string(data), -1)
-		words := re.Split(string(data), -1)
+		counts[prop.Name]++
+		count := counts[prop.Name]
 
-		if headings == nil {
-			deleteFileParametersRedis(conn, file.BlokingID)
-			continue
+		switch {
+		case declared[prop.Name] || (count > 1 && config.DuplicateProperties != "suffix"):
+			switch values := paramets[prop.Name].(type) {
+			case []string:
+				paramets[prop.Name] = append(values, prop.Value)
+			case string:
+				paramets[prop.Name] = []string{values, prop.Value}
+			default:
+				paramets[prop.Name] = []string{prop.Value}
+			}
+		case count > 1:
+			paramets[prop.Name+"_"+strconv.Itoa(count)] = prop.Value
+		default:
+			paramets[prop.Name] = prop.Value
 		}
+	}
 
-		var mapEventsBuffer = map[string]*bytes.Buffer{}
-		mapIndicies := make(map[string]string)
-
-		// 0.9. разбор строк, разделенных регулярным выражением по времени событий
-		// пробегаемся по частям строк с заголовками
-		var IndexPostfix int = 0
-
-		for idx, word := range headings {
-			word := strings.TrimRight(word, "-")
-
-			dataEvent := getDateEvent(file.FileDate, word)
-			var multilineMap = make(map[string]string)
+	paramets["processNameID"] = file.ProcessNameID
+	paramets["processName"] = file.ProcessName
+	if file.ProcessID != "" {
+		paramets["processID"] = file.ProcessID
+	}
+	// теги источника не перекрывают свойства события
+	for name, value := range file.Source.Tags {
+		if _, ok := paramets[name]; !ok {
+			paramets[name] = value
+		}
+	}
+	paramets["SourceFile"] = file.Path
 
-			if reContextstrings.MatchString(words[idx+1]) {
+	techEvent := newTechLogEvent(paramets, clock, event.Header)
 
-				lenWords := len(words[idx+1])
-				garbageStrings := reContextstrings.Split(words[idx+1], -1)
+	// обработчики полей применяются до вычисления производных полей, чтобы скрытые и удаленные
+	// значения не попадали в них, в анализ блокировок и в связь с вызовами
+	applyProcessors(file.Source.processors, techEvent)
 
-				var tmpLen int = 0
+	// нормализованные тексты запросов для группировки по форме запроса
+	if config.NormalizeQueries {
+		addNormalizedQueries(techEvent.Fields)
+	}
+	// строки стека контекста для группировки по точке входа и строке кода
+	if config.SplitContext {
+		addContextFrames(techEvent.Fields)
+	}
+	return techEvent
+}
 
-				for i := len(garbageStrings) - 1; i > 0; i-- {
+// jobResult результат задания: номер пакета и ошибки чтения его файлов
+type jobResult struct {
+	id  int
+	err error
+}
 
-					garbageString := strings.TrimRight(garbageStrings[i], ",")
+// задание обработки пакета файлов: события каждого файла читаются с сохраненной позиции и отправляются
+// в приемники, после отправки позиция файла сохраняется и блокировка файла снимается. Файл, который
+// не удалось прочитать, пропускается до следующего прохода без сохранения позиции, ошибки файлов
+// передаются в канал c вместе с номером пакета.
+func jobExtractTechLogs(filesInPackage []files, keyInPackage int, config *conf, store checkpointStore, c chan jobResult, stop <-chan struct{}) {
 
-					var sb strings.Builder
-					var lenSb int = 0
-					lenGarbageString := len(garbageStrings[i])
+	// 1. создаем приемники событий
+	outputs, err := newOutputs(config)
+	if err != nil {
+		for _, file := range filesInPackage {
+			store.unlockFile(file.Path)
+		}
+		c <- jobResult{id: keyInPackage, err: fmt.Errorf("creating the output: %v", err)}
+		return
+	}
 
-					for j := (lenWords - lenGarbageString - tmpLen - 1); j > 0; j-- {
+	// 2. считываем мэппинг для индексов elastic из map файлов
+	multiValued := getMultiValuedFields(getMappings())
 
-						c := words[idx+1][j]
-						lenSb++
+	// 3. работаем с файлами
+	var errs []string
 
-						if isLetter(rune(c)) {
-							sb.WriteByte(c)
-						} else if c == ',' {
-							break
-						}
-					}
+	for i, file := range filesInPackage {
 
-					tmpLen += lenSb + lenGarbageString
-					replaceSymbols(&garbageString, config)
-					multilineMap[strings.ToLower(Reverse(sb.String()))] = garbageString
-				}
-				rightString = strings.TrimRight(garbageStrings[0], ",")
-			} else {
-				rightString = words[idx+1]
-				replaceSymbols(&rightString, config)
+		// при остановке службы дочитывать оставшиеся файлы пакета не будем, снимем с них блокировки
+		if isStopped(stop) {
+			for _, skipped := range filesInPackage[i:] {
+				store.unlockFile(skipped.Path)
 			}
+			break
+		}
 
-			replaceGaps(&rightString, `(?m)('[\S\s]*?')|("[\S\s]*?")`, ",", " ")
+		openFile, err := openTechLogFile(file, file.LastPosition)
+		if err != nil {
+			store.unlockFile(file.Path)
+			errs = append(errs, fmt.Sprintf("open %s: %v", file.Path, err))
+			continue
+		}
 
-			paramets := getMapEvent(&rightString)
-			paramets["date"] = dataEvent
-			paramets["processNameID"] = file.ProcessNameID
+		// события читаются по одному, пакеты приемников отправляются при достижении размера пакета.
+		// trigger - смещение события, после чтения которого события передаются на отправку. События, переданные
+		// до позиции file.Sent (file.OutputsSent приемника), уже приняты при предыдущем чтении файла
+		countEvents := 0
+		outputs.begin(&file)
 
-			for keyM, valueM := range multilineMap {
-				paramets[keyM] = valueM
-			}
-			paramets["SourceFile"] = file.Path
+		var errFile error
+		pipeline := newFilePipeline(config, file, openFile, file.LastPosition, multiValued, func(item *fileEvent, trigger int64) {
+
+			techEvent := item.event
 
 			// Конвертация карты в JSON
-			empData, err := json.Marshal(paramets)
+			empData, err := json.Marshal(techEvent.document())
 			if err != nil {
-				deleteFileParametersRedis(conn, file.BlokingID)
-				logr.WithFields(logr.Fields{
-					"object": "Data",
-					"title":  "Failure marshal struct",
-				}).Fatal(err)
+				if errFile == nil {
+					errFile = fmt.Errorf("marshal event at %d: %v", item.raw.Start, err)
+				}
+				return
 			}
 
-			hash := md5.Sum(empData)
-			md5String := hex.EncodeToString(hash[:])
-
-			// if len(empData) > config.ElasticMaxContentLength {
-			// 	empData = empData[:config.ElasticMaxContentLength]
-			// }
+			outputs.send(&outputEvent{
+				Name:          techEvent.Name,
+				ID:            item.raw.documentID(file.Path),
+				Source:        file.Source,
+				File:          file.Path,
+				ProcessNameID: file.ProcessNameID,
+				Document:      empData,
+			}, trigger)
+		})
 
-			jsonStr := append(empData, "\n"...)
+		lockLost := false
+		for {
+			// все приемники вернули ошибку - файл будет прочитан повторно при следующем проходе
+			if _, all := outputs.failed(); all {
+				break
+			}
+			// блокировка потеряна - файл может обрабатывать другой инстанс
+			if store.lockLost(file.Path) {
+				lockLost = true
+				break
+			}
+			// при остановке службы отправляем уже прочитанные события и сохраняем позицию после них
+			if isStopped(stop) {
+				break
+			}
 
-			// заголовок bulk
-			idxName := strings.Replace(indexName, "{event}", strings.ToLower(paramets["event_techlog"]), -1)
-			mapIndicies[paramets["event_techlog"]] = idxName
+			ok, err := pipeline.next()
+			if err != nil && errFile == nil {
+				errFile = err
+			}
+			if !ok || errFile != nil {
+				break
+			}
+			countEvents++
+		}
+		openFile.Close()
 
-			meta := []byte(fmt.Sprintf(`{ "index" : { "_index" : "%s","_id" : "%s" } }%s`, idxName, md5String, "\n"))
+		// файл не дочитан - позиция не сохраняется, файл будет прочитан повторно при следующем проходе
+		if errFile != nil {
+			store.unlockFile(file.Path)
+			errs = append(errs, fmt.Sprintf("read %s: %v", file.Path, errFile))
+			continue
+		}
+		if lockLost {
+			store.unlockFile(file.Path)
+			continue
+		}
 
-			keyBuffer := paramets["event_techlog"] + "_" + strconv.Itoa(IndexPostfix)
-			if mapEventsBuffer[keyBuffer] == nil {
-				mapEventsBuffer[keyBuffer] = new(bytes.Buffer)
+		// позиция после последнего завершенного события, незавершенный хвост будет дочитан в следующий раз
+		currentPosition := pipeline.reader.committed
+		hour := pipeline.clock.hourState()
+
+		if pipeline.correlator != nil {
+			if !isStopped(stop) && pipeline.clock.hourEnded(time.Now()) {
+				// файл больше не дописывается - вызова для ожидающих событий уже не будет
+				pipeline.flush(currentPosition)
+			} else if first := pipeline.earliest(); first != nil {
+				// файл будет дочитан с первого ожидающего вызова события
+				currentPosition = first.raw.Start
+				hour = first.hour
 			}
-			// заголовок + source события
-			mapEventsBuffer[keyBuffer].Grow(len(meta) + len(jsonStr))
-			mapEventsBuffer[keyBuffer].Write(meta)
-			mapEventsBuffer[keyBuffer].Write(jsonStr)
+		}
 
-			if int64(mapEventsBuffer[keyBuffer].Len()) >= config.ElasticBulkSize {
-				IndexPostfix++
-			}
+		if countEvents == 0 {
+			store.unlockFile(file.Path)
+			continue
 		}
 
 		if config.LogLevel == 3 {
@@ -509,111 +512,86 @@ func jobExtractTechLogs(filesInPackage []files, keyInPackage int, config *conf,
 				"title":  "Succeful reading",
 			}).Infof("Package %d, file %s, start_position: %d, end position: %d", keyInPackage, file.Path, file.LastPosition, currentPosition)
 		}
-		// обходим события. Каждому событию соответстует bulk буффер
-		for keyM, buf := range mapEventsBuffer {
-
-			keyMaster := keyM[0:strings.Index(keyM, "_")]
-			idxName := mapIndicies[keyMaster]
-			res, err = es.Indices.Exists([]string{idxName})
-			if err != nil && config.LogLevel == 2 {
-				logr.WithFields(logr.Fields{
-					"object": "Elastic",
-					"title":  "Indices.Exists",
-				}).Warning(err)
-			}
-			res.Body.Close()
-
-			if res.StatusCode == 404 {
-				currentMapping := mapping[strings.ToLower(keyMaster)]
-				_, err = es.Indices.Create(
-					idxName,
-					es.Indices.Create.WithBody(strings.NewReader(currentMapping)),
-					es.Indices.Create.WithWaitForActiveShards("1"),
-					es.Indices.Create.WithTimeout(60),
-				)
-				if err != nil {
-					deleteFileParametersRedis(conn, file.BlokingID)
-					logr.WithFields(logr.Fields{
-						"object": "Elastic",
-						"title":  "Cannot create index",
-					}).Fatal(err)
-				}
+		// отправляем оставшиеся пакеты приемников
+		outputs.flush(file.Path)
+
+		// ни один приемник не принял документы - файл будет отправлен повторно со старой позиции.
+		// Позицию файла, блокировка которого потеряна во время отправки, сохранит инстанс, взявший файл.
+		failedAny, failedAll := outputs.failed()
+		if failedAll || store.lockLost(file.Path) {
+			store.unlockFile(file.Path)
+			continue
+		}
+		// часть приемников не приняла документы - файл будет прочитан повторно со старой позиции,
+		// а приемники, принявшие документы, пропустят их по своим позициям
+		if failedAny {
+			currentPosition = file.LastPosition
+			hour = nil
+			if file.LastPosition > 0 {
+				hour = &file.HourState
 			}
+		}
 
-			// 0.11. отправляем в эластик
-			res, err = es.Bulk(
-				bytes.NewReader(buf.Bytes()),
-				es.Bulk.WithIndex(idxName),
-				es.Bulk.WithRefresh("false"),
-			)
-			if err != nil {
-				deleteFileParametersRedis(conn, file.BlokingID)
-				logr.WithFields(logr.Fields{
-					"object": "Elastic",
-					"title":  "Failure indexing batch",
-				}).Fatal(err)
-			}
-			// если ошибка запроса - выводим ошибку
-			if res.IsError() {
-				if err := json.NewDecoder(res.Body).Decode(&raw); err != nil {
-					deleteFileParametersRedis(conn, file.BlokingID)
-					logr.WithFields(logr.Fields{
-						"object": "Elastic",
-						"title":  "Failure to to parse response body",
-						"source": keyMaster,
-						"file":   file.Path,
-					}).Fatal(err)
-				} else {
-					deleteFileParametersRedis(conn, file.BlokingID)
-					logr.WithFields(logr.Fields{
-						"object": "Elastic",
-						"title":  "Request",
-					}).Errorf("[%d] %s: %s (%s)",
-						res.StatusCode,
-						raw["error"].(map[string]interface{})["type"],
-						raw["error"].(map[string]interface{})["reason"],
-						file,
-					)
-				}
-				// Успешный ответ может по-прежнему содержать ошибки для определенных документов...
-			} else {
-				if err := json.NewDecoder(res.Body).Decode(&blk); err != nil {
-					deleteFileParametersRedis(conn, file.BlokingID)
-					logr.WithFields(logr.Fields{
-						"object": "Elastic",
-						"title":  "Failure to to parse response body",
-						"source": keyMaster,
-						"file":   file.Path,
-					}).Fatal(err)
-				} else {
-					for _, d := range blk.Items {
-						// ... для любых других HTTP статусов > 201 ...
-						if d.Index.Status > 201 {
-							deleteFileParametersRedis(conn, file.BlokingID)
-							// ... и распечатать статус ответа и информацию об ошибке ...
-							logr.WithFields(logr.Fields{
-								"object": "Elastic",
-								"title":  "Request",
-							}).Errorf("[%d]: %s: %s: %s: %s",
-								d.Index.Status,
-								d.Index.Error.Type,
-								d.Index.Error.Reason,
-								d.Index.Error.Cause.Type,
-								d.Index.Error.Cause.Reason,
-							)
-						}
-					}
-				}
-			}
-			// Закрываем тело ответа, чтобы предотвратить достижение предела для горутин или дескрипторов файлов.
-			res.Body.Close()
+		// записываем позицию в базу
+		cp := file.Identity.newCheckpoint(currentPosition)
+		cp.Hour = hour
+		cp.setSent(outputs.outputsSent(pipeline.reader.committed))
+		store.setCheckpoint(file.Path, cp)
+		store.unlockFile(file.Path) // снимаем блокировку после сохранения позиции
+	}
+
+	result := jobResult{id: keyInPackage}
+	if len(errs) > 0 {
+		result.err = errors.New(strings.Join(errs, "; "))
+	}
+	c <- result
+}
+
+// отправка производных документов анализа блокировок в приемники, индексы - по шаблонам их источников.
+// Ожидания, из которых получены документы, повторно не читаются, поэтому документы, не принятые
+// приемником, сохраняются в приемник dead_letter и отправляются командой deadletter replay.
+// Ошибка означает, что документы не отправлены и не сохранены.
+func sendDerivedDocuments(config *conf, docs []*derivedDocument) error {
+
+	if len(docs) == 0 {
+		return nil
+	}
+
+	outputs, err := newOutputs(config)
+	if err != nil {
+		return err
+	}
+	outputs.begin(&files{})
+
+	var events []*outputEvent
+	for _, doc := range docs {
+		empData, err := json.Marshal(doc.Event.document())
+		if err != nil {
+			return err
 		}
-		deleteFileParametersRedis(conn, file.BlokingID)          // удаляем ключ
-		setFileParametersRedis(conn, file.Path, currentPosition) // записываем позицию в базу
+
+		event := &outputEvent{
+			Name:          doc.Event.Name,
+			ID:            doc.ID,
+			Source:        doc.Source,
+			File:          doc.File.Path,
+			ProcessNameID: doc.File.ProcessNameID,
+			Document:      empData,
+		}
+		events = append(events, event)
+		outputs.send(event, 0)
 	}
-	c <- keyInPackage
+	outputs.flush("")
+
+	if err := config.deadLetters.write(outputs.deadLetters(events)); err != nil {
+		return fmt.Errorf("failure to save derived documents: %v", err)
+	}
+	return nil
 }
 
+// текущий файл лога программы
+var currentLogFile *os.File
+
 func initLogging(c *conf) {
 
 	year, month, day := time.Now().Date()
@@ -631,6 +609,12 @@ func initLogging(c *conf) {
 	logr.SetFormatter(&logr.JSONFormatter{})
 	logr.SetOutput(fileLog)
 
+	// в режиме службы лог переоткрывается ежедневно, предыдущий файл закрываем
+	if currentLogFile != nil {
+		currentLogFile.Close()
+	}
+	currentLogFile = fileLog
+
 }
 
 func deleteOldLogFiles(c *conf) {
@@ -674,7 +658,7 @@ func getFilesArray(root string) ([]files, error) {
 	var arrFiles []files
 
 	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
-		if !info.IsDir() {
+		if err == nil && !info.IsDir() {
 			arrFiles = append(arrFiles, files{Path: path, Size: info.Size(), DataCreate: info.ModTime()})
 		}
 		return nil
@@ -682,85 +666,38 @@ func getFilesArray(root string) ([]files, error) {
 	return arrFiles, err
 }
 
-// =======================================================================================
-func main() {
+// один проход по каталогу тех журнала: отбор новых данных, распределение файлов по пакетам и их обработка.
+// Закрытие канала stop прерывает проход после обработки текущих файлов. Ошибка означает, что часть
+// файлов не прочитана, они будут прочитаны повторно при следующем проходе.
+func processTechLogs(config *conf, store checkpointStore, stop <-chan struct{}) error {
 
-	defer duration(track())
+	c := make(chan jobResult)
 
-	// считываем конфиг
-	var config conf
-	config.getConfig()
-
-	// подключаем логи
-	initLogging(&config)
-	deleteOldLogFiles(&config)
-
-	// maxdop установка
-	runtime.GOMAXPROCS(config.MaxDop)
-
-	// удалим ключи, которые больше не используются
-	conn, err := redis.Dial("tcp", config.RedisAddr,
-		redis.DialUsername(config.RedisLogin),
-		redis.DialPassword(config.RedisPassword),
-		redis.DialDatabase(config.RedisDatabase),
-	)
+	// архивы zip открываются один раз за проход
+	defer closeZipArchives()
 
-	if err != nil {
-		logr.WithFields(logr.Fields{
-			"object": "Redis",
-			"title":  "Unable to connect",
-		}).Fatal(err)
-	}
-	defer conn.Close()
+	// пока проход не завершен - продлеваем блокировки взятых файлов
+	heartbeat := make(chan struct{})
+	defer close(heartbeat)
+	startLocksHeartbeat(config, store, heartbeat)
 
-	// проверим что es доступен
-	es, err := createElasticsearchClient(&config)
-	if err != nil {
-		logr.WithFields(logr.Fields{
-			"object": "Elastic",
-			"title":  "Creating the client",
-		}).Fatal(err)
-	}
-
-	res, err := es.Info()
-	if err != nil {
-		logr.WithFields(logr.Fields{
-			"object": "Elastic",
-			"title":  "Unable to get response",
-		}).Fatal(err)
-	}
-	res.Body.Close()
-
-	keys, _ := redis.Strings(conn.Do("KEYS", "*"))
-	for _, key := range keys {
-		var currKey string
-		if strings.Contains(key, "job_") {
-			currKey = strings.Replace(key, "job_", "", -1)
-		} else {
-			currKey = key
-		}
-		if _, err := os.Stat(currKey); err != nil {
-			if os.IsNotExist(err) {
-				// если файла больше нет - удалим запись из базы
-				deleteFileParametersRedis(conn, key)
-			} else {
-				logr.WithFields(logr.Fields{
-					"object": "File tech journal",
-				}).Warning(err)
-			}
+	// получаем файлы логов всех источников, сортируем по размеру, определяем в пакеты заданий
+	var arr []files
+	for _, source := range config.sources {
+		sourceFiles, err := getTechLogFiles(source.Path)
+		if err != nil {
+			logr.WithFields(logr.Fields{
+				"object": "Data",
+				"title":  "Failure to scan directory",
+				"source": source.Name,
+			}).Error(err)
 		}
+		for i := range sourceFiles {
+			sourceFiles[i].Source = source
+		}
+		arr = append(arr, sourceFiles...)
 	}
-
-	c := make(chan int)
-
-	// получаем файлы логов, сортируем по размеру, определяем в пакеты заданий
-	arr, err := getFilesArray(config.Path)
-	if err != nil {
-		logr.WithFields(logr.Fields{
-			"object": "Data",
-			"title":  "Failure to scan directory",
-		}).Error(err)
-	}
+	pruneReportedUnmatchedFiles(arr)
 
 	/* проверяем что файлы не заблокированы, ставим блокировку в основном сеансе
 	считываем позицию файла и сравниваем с текущим размером, если ничего не изменилось -
@@ -768,36 +705,65 @@ func main() {
 	*/
 
 	var listFiles []*files
-	separator := string(os.PathSeparator)
-
 	for i := 0; i < len(arr); i++ {
 
-		// проверим что файла нет в текущей обработке
-		jobFile := "job_" + arr[i].Path
-		if getFileParametersRedis(conn, jobFile) == 1 {
+		if arr[i].Size < 100 {
+			continue
+		}
+
+		// получаем дату и процесс из пути файла, файлы другой структуры пропускаем
+		info, ok := arr[i].Source.pathPattern.matchFile(arr[i].Source.Path, arr[i])
+		if !ok {
+			if !reportedUnmatchedFiles[arr[i].Path] {
+				reportedUnmatchedFiles[arr[i].Path] = true
+				logr.WithFields(logr.Fields{
+					"object": "File tech journal",
+					"title":  "File does not match path_pattern, skipped",
+				}).Warning(arr[i].Path)
+			}
 			continue
 		}
 
-		// получаем последнюю прочитанную позицию из redis
-		lastPosition := getFileParametersRedis(conn, arr[i].Path)
-		if lastPosition == arr[i].Size || arr[i].Size < 100 {
+		// получаем последнюю прочитанную позицию из хранилища и сверяем, что файл тот же самый
+		identity, err := getFileIdentity(arr[i])
+		if err != nil {
+			logr.WithFields(logr.Fields{
+				"object": "File tech journal",
+				"title":  "Failure to read file identity",
+			}).Warning(err)
 			continue
 		}
 
-		// получаем дату из имени файла и тип процесса
-		fileSplitter := strings.Split(arr[i].Path, separator)
-		lenArray := len(fileSplitter)
-		if lenArray < 2 {
+		cp := store.getCheckpoint(arr[i].Path)
+		lastPosition, reason := cp.resolvePosition(identity, arr[i].Size)
+		if reason != "" && config.LogLevel == 3 {
+			logr.WithFields(logr.Fields{
+				"object": "File tech journal",
+				"title":  "Reading from the beginning",
+			}).Infof("file %s was %s", arr[i].Path, reason)
+		}
+		if lastPosition == arr[i].Size {
 			continue
 		}
 
-		// устанавливаем блокировку на файл
-		setFileParametersRedis(conn, jobFile, 1)
+		// устанавливаем блокировку на файл, если файл уже в обработке - пропускаем
+		if !store.lockFile(arr[i].Path) {
+			continue
+		}
 
 		arr[i].LastPosition = lastPosition
-		arr[i].FileDate = strings.TrimRight(fileSplitter[lenArray-1], ".log")
-		arr[i].ProcessNameID = strings.ToLower(fileSplitter[lenArray-2])
-		arr[i].BlokingID = jobFile
+		arr[i].Identity = identity
+		arr[i].FileDate = info.FileDate
+		arr[i].ProcessNameID = info.processNameID()
+		arr[i].ProcessName = info.Process
+		arr[i].ProcessID = info.PID
+		if lastPosition > 0 && cp.Hour != nil {
+			arr[i].HourState = *cp.Hour
+		}
+		if reason == "" {
+			arr[i].Sent = cp.Sent
+			arr[i].OutputsSent = cp.Outputs
+		}
 
 		listFiles = append(listFiles, &arr[i])
 	}
@@ -814,14 +780,134 @@ func main() {
 	packages := getFilesPacked(listFiles, config.MaxDop)
 
 	for keyInPackage, filesInPackage := range packages {
-		go jobExtractTechLogs(filesInPackage, keyInPackage, &config, c)
+		go jobExtractTechLogs(filesInPackage, keyInPackage, config, store, c, stop)
 	}
 
+	var errs []string
 	for i := 0; i < len(packages); i++ {
-		gopherID := <-c // Получает значение от канала
+		result := <-c // Получает значение от канала
+		if result.err != nil {
+			errs = append(errs, fmt.Sprintf("package %d: %v", result.id, result.err))
+			continue
+		}
 		logr.WithFields(logr.Fields{
-			"job id": gopherID,
+			"job id": result.id,
 			"status": "ok",
 		}).Info("Job extract tech log 1C")
 	}
+
+	// цепочки ожиданий блокировок по всем файлам прохода
+	if config.locks != nil {
+		if err := sendDerivedDocuments(config, config.locks.flush()); err != nil {
+			logr.WithFields(logr.Fields{
+				"object": "Output",
+				"title":  "Failure sending derived documents",
+			}).Error(err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// =======================================================================================
+func main() {
+
+	// считываем конфиг
+	var config conf
+	config.getConfig()
+
+	// служебные команды, например просмотр блокировок
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(&config, os.Args[1:]))
+	}
+
+	defer duration(track())
+
+	// подключаем логи
+	initLogging(&config)
+	deleteOldLogFiles(&config)
+
+	// источники тех журнала
+	if err := config.initSources(); err != nil {
+		logr.WithFields(logr.Fields{
+			"object": "Config",
+			"title":  "Invalid sources",
+		}).Fatal(err)
+	}
+	if err := config.initCorrelation(); err != nil {
+		logr.WithFields(logr.Fields{
+			"object": "Config",
+			"title":  "Invalid correlate_events",
+		}).Fatal(err)
+	}
+	if config.AnalyzeLocks {
+		config.locks = newLockAnalyzer()
+	}
+	if err := config.initOutputs(); err != nil {
+		logr.WithFields(logr.Fields{
+			"object": "Config",
+			"title":  "Invalid outputs",
+		}).Fatal(err)
+	}
+	if err := config.initDeadLetters(); err != nil {
+		logr.WithFields(logr.Fields{
+			"object": "Config",
+			"title":  "Invalid dead_letter",
+		}).Fatal(err)
+	}
+
+	// maxdop установка
+	runtime.GOMAXPROCS(config.MaxDop)
+
+	// хранилище позиций файлов и блокировок
+	store, err := openCheckpointStore(&config)
+	if err != nil {
+		logr.WithFields(logr.Fields{
+			"object": "Checkpoint store",
+			"title":  "Unable to connect",
+		}).Fatal(err)
+	}
+	defer store.close()
+	defer closeOutputs()
+
+	// проверим что приемники Elasticsearch доступны
+	for _, oc := range config.outputs {
+		if oc.Type != outputElastic {
+			continue
+		}
+		es, err := createElasticsearchClient(getElasticConf(&config, oc))
+		if err != nil {
+			logr.WithFields(logr.Fields{
+				"object": "Elastic",
+				"title":  "Creating the client",
+			}).Fatal(err)
+		}
+
+		res, err := es.Info()
+		if err != nil {
+			logr.WithFields(logr.Fields{
+				"object": "Elastic",
+				"title":  "Unable to get response",
+			}).Fatal(err)
+		}
+		res.Body.Close()
+	}
+
+	// удалим записи, которые больше не используются
+	store.deleteUnused()
+
+	if config.Daemon {
+		runDaemon(&config, store)
+		return
+	}
+
+	if err := processTechLogs(&config, store, nil); err != nil {
+		logr.WithFields(logr.Fields{
+			"object": "Data",
+			"title":  "Read file data",
+		}).Error(err)
+	}
 }
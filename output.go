@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	logr "github.com/sirupsen/logrus"
+)
+
+// типы приемников событий
+const (
+	outputElastic    = "elasticsearch"
+	outputFile       = "file"
+	outputClickHouse = "clickhouse"
+	outputWebhook    = "webhook"
+	outputKafka      = "kafka"
+)
+
+// размер пакета приемника по умолчанию в байтах, если не задан ни bulk_size, ни elastic_bulksize
+const defaultOutputBulkSize = 5000000
+
+// таймаут запроса к ClickHouse, webhook и Kafka по умолчанию, в секундах
+const defaultOutputTimeout = 30
+
+// outputConf приемник событий. Без секции outputs события отправляются в Elasticsearch
+// по параметрам верхнего уровня elastic_*.
+type outputConf struct {
+	Type string `yaml:"type"`
+	// Name имя приемника, под которым хранятся его позиции файлов, по умолчанию - тип и номер: kafka_2
+	Name string `yaml:"name"`
+	// URL адрес Elasticsearch, ClickHouse или webhook. Для Elasticsearch по умолчанию - elastic_addr
+	URL      string `yaml:"url"`
+	Login    string `yaml:"login"`
+	Password string `yaml:"password"`
+	// Index шаблон индекса Elasticsearch, по умолчанию - elastic_indx источника
+	Index string `yaml:"index"`
+	// Database, Table база и шаблон таблицы ClickHouse, {event} - имя события
+	Database string `yaml:"database"`
+	Table    string `yaml:"table"`
+	// FallbackTable таблица ClickHouse для событий без карты, документ хранится в ней текстом JSON
+	FallbackTable string `yaml:"fallback_table"`
+	// Path шаблон пути файла NDJSON, {event} - имя события
+	Path string `yaml:"path"`
+	// Headers заголовки запросов webhook, например авторизация
+	Headers map[string]string `yaml:"headers"`
+	// Brokers, Topic брокеры и шаблон топика Kafka, {event} - имя события
+	Brokers []string `yaml:"brokers"`
+	Topic   string   `yaml:"topic"`
+	// Key ключ сообщений Kafka: event - имя события, processNameID - процесс
+	Key             string `yaml:"key"`
+	Compression     string `yaml:"compression"`
+	MaxMessageBytes int    `yaml:"max_message_bytes"`
+	TLS             bool   `yaml:"tls"`
+	// BulkSize размер пакета в байтах, по умолчанию - elastic_bulksize
+	BulkSize int64 `yaml:"bulk_size"`
+	// Timeout таймаут запроса в секундах
+	Timeout int `yaml:"timeout"`
+}
+
+// outputEvent документ события для отправки в приемники
+type outputEvent struct {
+	// Name имя события: CALL, DBMSSQL, LOCKCHAIN
+	Name string
+	// ID идентификатор документа, одинаковый при повторном чтении файла
+	ID     string
+	Source *logSource
+	// File путь файла тех журнала
+	File          string
+	ProcessNameID string
+	// Document документ в JSON
+	Document []byte
+}
+
+// output приемник событий. Приемник накапливает документы пакетами и отправляет их при достижении
+// размера пакета и по flush. Ошибка означает, что документы могли не дойти до приемника
+// и позицию файла тех журнала сдвигать нельзя.
+type output interface {
+	send(event *outputEvent) error
+	flush() error
+}
+
+// getOutputConfs возвращает приемники из секции outputs, без нее - единственный приемник Elasticsearch
+func (c *conf) getOutputConfs() []outputConf {
+
+	if len(c.Outputs) == 0 {
+		return []outputConf{{Type: outputElastic}}
+	}
+	return c.Outputs
+}
+
+// initOutputs проверяет настройки приемников и заполняет незаданные значения
+func (c *conf) initOutputs() error {
+
+	c.outputs = nil
+	for i, oc := range c.getOutputConfs() {
+
+		if oc.BulkSize <= 0 {
+			oc.BulkSize = c.ElasticBulkSize
+		}
+		if oc.BulkSize <= 0 {
+			oc.BulkSize = defaultOutputBulkSize
+		}
+		if oc.Timeout <= 0 {
+			oc.Timeout = defaultOutputTimeout
+		}
+
+		if oc.Name == "" {
+			oc.Name = fmt.Sprintf("%s_%d", oc.Type, i+1)
+		}
+
+		switch oc.Type {
+		case outputElastic:
+			if oc.URL == "" {
+				oc.URL = c.ElasticAddr
+				oc.Login = c.ElasticLogin
+				oc.Password = c.ElasticPassword
+			}
+		case outputFile:
+			if oc.Path == "" {
+				return fmt.Errorf("output %d (%s): path is required", i+1, oc.Type)
+			}
+		case outputClickHouse:
+			if oc.URL == "" {
+				return fmt.Errorf("output %d (%s): url is required", i+1, oc.Type)
+			}
+			if oc.Database == "" {
+				oc.Database = defaultClickHouseDatabase
+			}
+			if oc.Table == "" {
+				oc.Table = defaultClickHouseTable
+			}
+			if oc.FallbackTable == "" {
+				oc.FallbackTable = defaultClickHouseFallbackTable
+			}
+		case outputWebhook:
+			if oc.URL == "" {
+				return fmt.Errorf("output %d (%s): url is required", i+1, oc.Type)
+			}
+		case outputKafka:
+			if err := checkKafkaConf(&oc); err != nil {
+				return fmt.Errorf("output %d (%s): %v", i+1, oc.Type, err)
+			}
+		default:
+			return fmt.Errorf("output %d: unknown type %q", i+1, oc.Type)
+		}
+
+		c.outputs = append(c.outputs, oc)
+	}
+	return nil
+}
+
+// getOutputConf приемник с именем name, false - приемника нет в настройках
+func (c *conf) getOutputConf(name string) (outputConf, bool) {
+	for _, oc := range c.outputs {
+		if oc.Name == name {
+			return oc, true
+		}
+	}
+	return outputConf{}, false
+}
+
+// getOutputType тип приемника с именем name, пусто - приемника нет в настройках
+func (c *conf) getOutputType(name string) string {
+	oc, _ := c.getOutputConf(name)
+	return oc.Type
+}
+
+// closeOutputs освобождает общие клиенты приемников при завершении парсера
+func closeOutputs() {
+	closeKafkaWriters()
+}
+
+// outputFanOut отправляет каждый документ во все приемники. Приемник, вернувший ошибку, пропускает
+// остальные документы файла, а остальные приемники продолжают отправку. Позиция файла сдвигается,
+// только когда документы приняли все приемники, а до этого для каждого приемника сохраняется позиция,
+// до которой он уже принял документы, чтобы при повторном чтении файла не отправлять их ему снова.
+type outputFanOut struct {
+	config  *conf
+	outputs []*fanOutput
+}
+
+// fanOutput приемник в составе outputFanOut
+type fanOutput struct {
+	oc  outputConf
+	out output
+	// sent позиция файла, до которой документы приняты приемником при предыдущих чтениях файла
+	sent int64
+	// failed ошибка отправки текущего файла
+	failed error
+}
+
+// newOutputs создает приемники для одного задания. Задания работают параллельно,
+// поэтому каждое накапливает пакеты в своих приемниках.
+func newOutputs(config *conf) (*outputFanOut, error) {
+
+	fanOut := &outputFanOut{config: config}
+	for _, oc := range config.outputs {
+		out, err := newOutput(config, oc)
+		if err != nil {
+			return nil, err
+		}
+		fanOut.outputs = append(fanOut.outputs, &fanOutput{oc: oc, out: out})
+	}
+	return fanOut, nil
+}
+
+func newOutput(config *conf, oc outputConf) (output, error) {
+
+	var out output
+	var err error
+
+	switch oc.Type {
+	case outputElastic:
+		out, err = newElasticOutput(config, oc)
+	case outputFile:
+		out = newFileOutput(oc)
+	case outputClickHouse:
+		out = newClickHouseOutput(config, oc)
+	case outputWebhook:
+		out = newWebhookOutput(config, oc)
+	case outputKafka:
+		out = newKafkaOutput(config, oc)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", oc.Name, err)
+	}
+	return out, nil
+}
+
+// begin начинает отправку файла: позиции, до которых приемники уже приняли документы файла
+func (o *outputFanOut) begin(file *files) {
+	for _, fo := range o.outputs {
+		fo.sent = maxInt64(file.Sent, file.OutputsSent[fo.oc.Name])
+		fo.failed = nil
+	}
+}
+
+// send передает документ приемникам, которые еще не приняли его при предыдущих чтениях файла.
+// trigger - смещение события, после чтения которого документ передается на отправку.
+func (o *outputFanOut) send(event *outputEvent, trigger int64) {
+	for _, fo := range o.outputs {
+		if fo.failed != nil || trigger < fo.sent {
+			continue
+		}
+		if err := fo.out.send(event); err != nil {
+			o.fail(fo, event.File, err)
+		}
+	}
+}
+
+// flush отправляет оставшиеся пакеты приемников
+func (o *outputFanOut) flush(file string) {
+	for _, fo := range o.outputs {
+		if fo.failed != nil {
+			continue
+		}
+		if err := fo.out.flush(); err != nil {
+			o.fail(fo, file, err)
+		}
+	}
+}
+
+// fail отключает приемник до конца файла. Накопленные пакеты приемника сбрасываются: файл будет
+// прочитан повторно с позиции, до которой приемник принял документы.
+func (o *outputFanOut) fail(fo *fanOutput, file string, err error) {
+
+	fo.failed = err
+	logr.WithFields(logr.Fields{
+		"object": "Output",
+		"title":  "Failure sending events",
+		"output": fo.oc.Name,
+		"file":   file,
+	}).Error(err)
+
+	out, errNew := newOutput(o.config, fo.oc)
+	if errNew != nil {
+		logr.WithFields(logr.Fields{
+			"object": "Output",
+			"title":  "Creating the output",
+		}).Fatal(errNew)
+	}
+	fo.out = out
+}
+
+// failed приемники, не принявшие документы текущего файла: ни одного, часть или все
+func (o *outputFanOut) failed() (any bool, all bool) {
+	all = true
+	for _, fo := range o.outputs {
+		if fo.failed != nil {
+			any = true
+		} else {
+			all = false
+		}
+	}
+	return any, all
+}
+
+// err первая ошибка приемников текущего файла
+func (o *outputFanOut) err() error {
+	for _, fo := range o.outputs {
+		if fo.failed != nil {
+			return fmt.Errorf("%s: %v", fo.oc.Name, fo.failed)
+		}
+	}
+	return nil
+}
+
+// deadLetters записи для приемника dead_letter: документы events для каждого приемника, не принявшего их.
+// Индекс записи не заполняется - при повторной отправке документ передается приемнику как при чтении файла.
+func (o *outputFanOut) deadLetters(events []*outputEvent) []*deadLetter {
+
+	var letters []*deadLetter
+	for _, fo := range o.outputs {
+		if fo.failed == nil {
+			continue
+		}
+		for _, event := range events {
+			letters = append(letters, &deadLetter{
+				Time:        time.Now().Format(eventDateFormat),
+				Output:      fo.oc.Name,
+				ID:          event.ID,
+				Event:       event.Name,
+				SourceFile:  event.File,
+				ErrorType:   "output_error",
+				ErrorReason: fo.failed.Error(),
+				Document:    string(event.Document),
+			})
+		}
+	}
+	return letters
+}
+
+// outputsSent позиции, до которых приемники приняли документы файла, после отправки событий до позиции
+// committed. Позиция приемника, не принявшего документы, не меняется.
+func (o *outputFanOut) outputsSent(committed int64) map[string]int64 {
+	sent := make(map[string]int64, len(o.outputs))
+	for _, fo := range o.outputs {
+		if fo.failed != nil {
+			sent[fo.oc.Name] = fo.sent
+		} else {
+			sent[fo.oc.Name] = maxInt64(committed, fo.sent)
+		}
+	}
+	return sent
+}
+
+// getOutputName имя индекса, таблицы или файла по шаблону: {event} - имя события в нижнем регистре,
+// yyyy, MM, dd, hh - текущая дата, как в elastic_indx
+func getOutputName(template string, event string) string {
+	return strings.Replace(getIndexName(template), "{event}", strings.ToLower(event), -1)
+}
+
+// newOutputHTTPClient HTTP клиент приемников ClickHouse и webhook
+func newOutputHTTPClient(config *conf, oc outputConf) *http.Client {
+	return &http.Client{
+		Timeout: time.Second * time.Duration(oc.Timeout),
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{
+				Timeout: time.Second * time.Duration(oc.Timeout),
+			}).DialContext,
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: config.InsecureSkipVerify,
+			},
+		},
+	}
+}
+
+// outputBatches пакеты документов NDJSON по имени таблицы или файла. Пакет отправляется функцией write
+// при достижении размера size и по flush.
+type outputBatches struct {
+	size    int64
+	buffers map[string]*bytes.Buffer
+	events  map[string]string
+	write   func(name string, event string, body []byte) error
+}
+
+func newOutputBatches(size int64, write func(name string, event string, body []byte) error) *outputBatches {
+	return &outputBatches{
+		size:    size,
+		buffers: make(map[string]*bytes.Buffer),
+		events:  make(map[string]string),
+		write:   write,
+	}
+}
+
+// add добавляет документ в пакет name
+func (b *outputBatches) add(name string, event *outputEvent) error {
+
+	buf := b.buffers[name]
+	if buf == nil {
+		buf = new(bytes.Buffer)
+		b.buffers[name] = buf
+		b.events[name] = event.Name
+	}
+	buf.Write(event.Document)
+	buf.WriteString("\n")
+
+	if int64(buf.Len()) >= b.size {
+		return b.send(name)
+	}
+	return nil
+}
+
+func (b *outputBatches) send(name string) error {
+	buf := b.buffers[name]
+	if buf == nil || buf.Len() == 0 {
+		return nil
+	}
+	if err := b.write(name, b.events[name], buf.Bytes()); err != nil {
+		return err
+	}
+	buf.Reset()
+	return nil
+}
+
+func (b *outputBatches) flush() error {
+	for name := range b.buffers {
+		if err := b.send(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resendOutputDeadLetters передает документы приемнику так же, как при чтении файла: индекс, таблица
+// или топик выбираются по событию и источнику файла. Возвращает документы, снова отклоненные приемником.
+func resendOutputDeadLetters(config *conf, oc outputConf, letters []*deadLetter) ([]*deadLetter, error) {
+
+	// приемник сохраняет отклоненные документы в dead_letter, здесь они собираются в памяти
+	collector := &deadLetterSink{mode: deadLetterMemory}
+	c := *config
+	c.deadLetters = collector
+
+	out, err := newOutput(&c, oc)
+	if err != nil {
+		return nil, err
+	}
+	for _, letter := range letters {
+		err := out.send(&outputEvent{
+			Name:     letter.Event,
+			ID:       letter.ID,
+			Source:   config.getFileSource(letter.SourceFile),
+			File:     letter.SourceFile,
+			Document: []byte(letter.Document),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", oc.Name, err)
+		}
+	}
+	if err := out.flush(); err != nil {
+		return nil, fmt.Errorf("%s: %v", oc.Name, err)
+	}
+	return collector.letters, nil
+}
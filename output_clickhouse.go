@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	logr "github.com/sirupsen/logrus"
+)
+
+// база ClickHouse по умолчанию
+const defaultClickHouseDatabase = "default"
+
+// шаблон таблицы ClickHouse по умолчанию
+const defaultClickHouseTable = "tech_journal_{event}"
+
+// таблица по умолчанию для событий без карты
+const defaultClickHouseFallbackTable = "tech_journal_other"
+
+// поле времени события, по нему таблицы сортируются и разбиваются на партиции
+const clickHouseTimeColumn = "@timestamp"
+
+// колонки таблицы событий без карты: время, имя события и весь документ текстом JSON
+var clickHouseFallbackColumns = []clickHouseColumn{
+	{Name: clickHouseTimeColumn, Type: "DateTime64(6)"},
+	{Name: "event_techlog", Type: "String"},
+	{Name: "document", Type: "String"},
+}
+
+// коды исключений ClickHouse, вызванных данными вставляемой строки. Пакет с такой ошибкой делится,
+// пока не останется строка, которая сохраняется в приемник dead_letter. Остальные ошибки
+// (недоступность, нехватка памяти, права) означают, что пакет нужно отправить повторно.
+var clickHouseRowErrors = map[int]string{
+	6:   "CANNOT_PARSE_TEXT",
+	26:  "CANNOT_PARSE_QUOTED_STRING",
+	27:  "CANNOT_PARSE_INPUT_ASSERTION_FAILED",
+	32:  "ATTEMPT_TO_READ_AFTER_EOF",
+	38:  "CANNOT_PARSE_DATE",
+	41:  "CANNOT_PARSE_DATETIME",
+	53:  "TYPE_MISMATCH",
+	69:  "ARGUMENT_OUT_OF_BOUND",
+	70:  "CANNOT_CONVERT_TYPE",
+	72:  "CANNOT_PARSE_NUMBER",
+	117: "INCORRECT_DATA",
+	131: "TOO_LARGE_STRING_SIZE",
+	321: "VALUE_IS_OUT_OF_RANGE_OF_DATA_TYPE",
+}
+
+// типы колонок ClickHouse по типам полей карт Elasticsearch. Остальные типы (вложенные объекты
+// locks_parsed, deadlock_edges) хранятся строкой JSON
+var clickHouseTypes = map[string]string{
+	"text":    "String",
+	"keyword": "String",
+	"long":    "Int64",
+	"integer": "Int32",
+	"date":    "DateTime64(6)",
+	"boolean": "UInt8",
+}
+
+// clickHouseTables таблицы, созданные и дополненные колонками за время работы парсера, по адресу, базе и имени
+var (
+	clickHouseTables   = make(map[string]bool)
+	clickHouseTablesMu sync.Mutex
+)
+
+// clickHouseOutput приемник ClickHouse: пакеты документов вставляются через HTTP интерфейс
+// в формате JSONEachRow, таблица выбирается по шаблону table. Таблица события создается
+// по карте события из maps, как индекс Elasticsearch, события без карты вставляются
+// в общую таблицу fallback_table.
+type clickHouseOutput struct {
+	config      *conf
+	oc          outputConf
+	client      *http.Client
+	batches     *outputBatches
+	mapping     map[string]string
+	multiValued map[string]map[string]bool
+	// rows документы пакетов по таблицам, для сохранения отклоненных строк
+	rows map[string][]*outputEvent
+}
+
+func newClickHouseOutput(config *conf, oc outputConf) *clickHouseOutput {
+	mapping := getMappings()
+	o := &clickHouseOutput{
+		config:      config,
+		oc:          oc,
+		client:      newOutputHTTPClient(config, oc),
+		mapping:     mapping,
+		multiValued: getMultiValuedFields(mapping),
+		rows:        make(map[string][]*outputEvent),
+	}
+	o.batches = newOutputBatches(oc.BulkSize, o.write)
+	return o
+}
+
+func (o *clickHouseOutput) send(event *outputEvent) error {
+
+	table := getOutputName(o.oc.Table, event.Name)
+	if _, ok := o.mapping[strings.ToLower(event.Name)]; !ok {
+		var err error
+		if event, err = getClickHouseFallbackRow(event); err != nil {
+			return err
+		}
+		table = o.oc.FallbackTable
+	}
+
+	o.rows[table] = append(o.rows[table], event)
+	return o.batches.add(table, event)
+}
+
+func (o *clickHouseOutput) flush() error {
+	return o.batches.flush()
+}
+
+// getClickHouseFallbackRow строка таблицы событий без карты: документ сохраняется целиком в колонку document
+func getClickHouseFallbackRow(event *outputEvent) (*outputEvent, error) {
+
+	var doc struct {
+		Timestamp string `json:"@timestamp"`
+	}
+	if err := json.Unmarshal(event.Document, &doc); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(map[string]string{
+		clickHouseTimeColumn: doc.Timestamp,
+		"event_techlog":      event.Name,
+		"document":           string(event.Document),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	row := *event
+	row.Document = data
+	return &row, nil
+}
+
+// write вставляет пакет в таблицу. Поля документа, которых нет в таблице, пропускаются,
+// даты в формате RFC 3339 с часовым поясом разбираются ClickHouse, вложенные объекты
+// и значения-массивы в колонках String сохраняются текстом JSON. Строки, которые ClickHouse
+// не смог разобрать, сохраняются в приемник dead_letter, остальные строки пакета вставляются.
+func (o *clickHouseOutput) write(table string, event string, body []byte) error {
+
+	letters, err := o.insert(table, event, o.rows[table])
+	if err != nil {
+		return err
+	}
+
+	for _, letter := range letters {
+		logr.WithFields(logr.Fields{
+			"object": "ClickHouse",
+			"title":  "Request",
+		}).Errorf("[%d]: %s: %s (%s)",
+			letter.Status,
+			letter.ErrorType,
+			letter.ErrorReason,
+			letter.SourceFile,
+		)
+	}
+	if err := o.config.deadLetters.write(letters); err != nil {
+		return fmt.Errorf("failure to save rejected documents: %v", err)
+	}
+
+	delete(o.rows, table)
+	return nil
+}
+
+// insert вставляет строки в таблицу и возвращает отклоненные строки. Если ClickHouse отклонил пакет
+// из-за данных строки, пакет делится пополам, пока отклоненная строка не останется одна.
+func (o *clickHouseOutput) insert(table string, event string, rows []*outputEvent) ([]*deadLetter, error) {
+
+	if err := o.ensureTable(table, event); err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+	for _, row := range rows {
+		body.Write(row.Document)
+		body.WriteString("\n")
+	}
+
+	err := o.exec("INSERT INTO "+o.tableName(table)+" FORMAT JSONEachRow", body.Bytes())
+	if err == nil {
+		return nil, nil
+	}
+
+	chErr, ok := err.(*clickHouseError)
+	if !ok || !chErr.rowError() {
+		// таблица могла быть удалена, при следующей отправке она будет создана заново
+		clickHouseTablesMu.Lock()
+		delete(clickHouseTables, o.tableKey(table))
+		clickHouseTablesMu.Unlock()
+		return nil, err
+	}
+
+	if len(rows) == 1 {
+		return []*deadLetter{newClickHouseDeadLetter(chErr, o.oc.Name, table, rows[0])}, nil
+	}
+
+	half := len(rows) / 2
+	letters, err := o.insert(table, event, rows[:half])
+	if err != nil {
+		return nil, err
+	}
+	tail, err := o.insert(table, event, rows[half:])
+	if err != nil {
+		return nil, err
+	}
+	return append(letters, tail...), nil
+}
+
+// newClickHouseDeadLetter запись отклоненной строки для приемника dead_letter
+func newClickHouseDeadLetter(err *clickHouseError, output string, table string, row *outputEvent) *deadLetter {
+	return &deadLetter{
+		Time:        time.Now().Format(eventDateFormat),
+		Output:      output,
+		Index:       table,
+		ID:          row.ID,
+		Event:       row.Name,
+		SourceFile:  row.File,
+		Status:      err.Status,
+		ErrorType:   err.errorType(),
+		ErrorReason: err.Message,
+		Document:    string(row.Document),
+	}
+}
+
+// resendClickHouseDeadLetters вставляет отклоненные строки в их таблицы пакетами bulk_size приемника
+// и возвращает снова отклоненные строки с новой причиной отказа
+func resendClickHouseDeadLetters(config *conf, oc outputConf, letters []*deadLetter) ([]*deadLetter, error) {
+
+	o := newClickHouseOutput(config, oc)
+
+	byTable := make(map[string][]*outputEvent)
+	var tables []string
+	for _, letter := range letters {
+		if byTable[letter.Index] == nil {
+			tables = append(tables, letter.Index)
+		}
+		byTable[letter.Index] = append(byTable[letter.Index], &outputEvent{
+			Name:     letter.Event,
+			ID:       letter.ID,
+			File:     letter.SourceFile,
+			Document: []byte(letter.Document),
+		})
+	}
+
+	var rejected []*deadLetter
+	for _, table := range tables {
+		rows := byTable[table]
+		for len(rows) > 0 {
+			n, size := 0, int64(0)
+			for n < len(rows) && (n == 0 || size < oc.BulkSize) {
+				size += int64(len(rows[n].Document)) + 1
+				n++
+			}
+			letters, err := o.insert(table, rows[0].Name, rows[:n])
+			if err != nil {
+				return nil, err
+			}
+			rejected = append(rejected, letters...)
+			rows = rows[n:]
+		}
+	}
+	return rejected, nil
+}
+
+// ensureTable создает таблицу события по карте, если ее нет, и добавляет колонки новых полей карты.
+// Таблица fallback_table создается с колонками clickHouseFallbackColumns.
+func (o *clickHouseOutput) ensureTable(table string, event string) error {
+
+	key := o.tableKey(table)
+	clickHouseTablesMu.Lock()
+	exists := clickHouseTables[key]
+	clickHouseTablesMu.Unlock()
+	if exists {
+		return nil
+	}
+
+	columns := clickHouseFallbackColumns
+	if table != o.oc.FallbackTable {
+		event = strings.ToLower(event)
+		data, ok := o.mapping[event]
+		if !ok {
+			return nil
+		}
+		var err error
+		columns, err = getClickHouseColumns(data, o.multiValued[event])
+		if err != nil {
+			return fmt.Errorf("map %s: %v", event, err)
+		}
+		if len(columns) == 0 {
+			return nil
+		}
+	}
+
+	if err := o.exec(getClickHouseCreateTable(o.tableName(table), columns), nil); err != nil {
+		return err
+	}
+	if err := o.exec(getClickHouseAddColumns(o.tableName(table), columns), nil); err != nil {
+		return err
+	}
+
+	clickHouseTablesMu.Lock()
+	clickHouseTables[key] = true
+	clickHouseTablesMu.Unlock()
+	return nil
+}
+
+func (o *clickHouseOutput) tableName(table string) string {
+	return quoteClickHouseName(o.oc.Database) + "." + quoteClickHouseName(table)
+}
+
+func (o *clickHouseOutput) tableKey(table string) string {
+	return o.oc.URL + "/" + o.oc.Database + "." + table
+}
+
+// exec выполняет запрос. Данные запроса INSERT передаются телом, запрос - параметром query,
+// запрос без данных передается телом.
+func (o *clickHouseOutput) exec(query string, body []byte) error {
+
+	params := url.Values{}
+	if body == nil {
+		body = []byte(query)
+	} else {
+		params.Set("query", query)
+		params.Set("input_format_skip_unknown_fields", "1")
+		params.Set("input_format_json_read_objects_as_strings", "1")
+		params.Set("input_format_json_read_arrays_as_strings", "1")
+		params.Set("date_time_input_format", "best_effort")
+	}
+
+	req, err := http.NewRequest(http.MethodPost, o.oc.URL+"/?"+params.Encode(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if o.oc.Login != "" {
+		req.Header.Set("X-ClickHouse-User", o.oc.Login)
+		req.Header.Set("X-ClickHouse-Key", o.oc.Password)
+	}
+
+	res, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		text, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		code, _ := strconv.Atoi(res.Header.Get("X-ClickHouse-Exception-Code"))
+		return &clickHouseError{
+			URL:     req.URL.Redacted(),
+			Status:  res.StatusCode,
+			Code:    code,
+			Message: string(bytes.TrimSpace(text)),
+		}
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	return nil
+}
+
+// clickHouseError ошибка запроса с кодом исключения ClickHouse из заголовка X-ClickHouse-Exception-Code
+type clickHouseError struct {
+	URL     string
+	Status  int
+	Code    int
+	Message string
+}
+
+func (e *clickHouseError) Error() string {
+	return fmt.Sprintf("%s: %d %s: %s", e.URL, e.Status, http.StatusText(e.Status), e.Message)
+}
+
+// rowError ошибка вызвана данными строк пакета: строку не удалось разобрать или пакет слишком большой
+func (e *clickHouseError) rowError() bool {
+	_, ok := clickHouseRowErrors[e.Code]
+	return ok || e.Status == http.StatusRequestEntityTooLarge
+}
+
+func (e *clickHouseError) errorType() string {
+	if name, ok := clickHouseRowErrors[e.Code]; ok {
+		return name
+	}
+	return strings.ReplaceAll(strings.ToLower(http.StatusText(e.Status)), " ", "_")
+}
+
+// clickHouseColumn колонка таблицы события
+type clickHouseColumn struct {
+	Name string
+	Type string
+}
+
+// getClickHouseColumns колонки таблицы по карте индекса события: типы полей переводятся по clickHouseTypes,
+// многозначные поля (_meta.multi_valued) становятся массивами этого типа: Array(String), Array(Int64).
+// Первая колонка - @timestamp, остальные по имени.
+func getClickHouseColumns(data string, multiValued map[string]bool) ([]clickHouseColumn, error) {
+
+	var m struct {
+		Mappings struct {
+			Properties map[string]struct {
+				Type string `json:"type"`
+			} `json:"properties"`
+		} `json:"mappings"`
+	}
+	if err := json.Unmarshal([]byte(data), &m); err != nil {
+		return nil, err
+	}
+
+	var columns []clickHouseColumn
+	for name, property := range m.Mappings.Properties {
+		columnType, ok := clickHouseTypes[property.Type]
+		if !ok {
+			columnType = "String"
+		}
+		if multiValued[strings.ToLower(name)] {
+			columnType = "Array(" + columnType + ")"
+		}
+		columns = append(columns, clickHouseColumn{Name: name, Type: columnType})
+	}
+
+	sort.Slice(columns, func(i, j int) bool {
+		if (columns[i].Name == clickHouseTimeColumn) != (columns[j].Name == clickHouseTimeColumn) {
+			return columns[i].Name == clickHouseTimeColumn
+		}
+		return columns[i].Name < columns[j].Name
+	})
+	return columns, nil
+}
+
+// getClickHouseCreateTable запрос создания таблицы MergeTree с партициями по месяцам @timestamp
+func getClickHouseCreateTable(table string, columns []clickHouseColumn) string {
+
+	var sb strings.Builder
+	sb.WriteString("CREATE TABLE IF NOT EXISTS " + table + " (\n")
+	timeColumn := false
+	for i, column := range columns {
+		if i > 0 {
+			sb.WriteString(",\n")
+		}
+		sb.WriteString("\t" + quoteClickHouseName(column.Name) + " " + column.Type)
+		if column.Name == clickHouseTimeColumn && column.Type == clickHouseTypes["date"] {
+			timeColumn = true
+		}
+	}
+	sb.WriteString("\n) ENGINE = MergeTree")
+	if timeColumn {
+		name := quoteClickHouseName(clickHouseTimeColumn)
+		sb.WriteString("\nPARTITION BY toYYYYMM(" + name + ")\nORDER BY " + name)
+	} else {
+		sb.WriteString("\nORDER BY tuple()")
+	}
+	return sb.String()
+}
+
+// getClickHouseAddColumns запрос добавления колонок, которые появились в карте после создания таблицы
+func getClickHouseAddColumns(table string, columns []clickHouseColumn) string {
+
+	clauses := make([]string, len(columns))
+	for i, column := range columns {
+		clauses[i] = "ADD COLUMN IF NOT EXISTS " + quoteClickHouseName(column.Name) + " " + column.Type
+	}
+	return "ALTER TABLE " + table + " " + strings.Join(clauses, ", ")
+}
+
+// quoteClickHouseName имя базы, таблицы или колонки в обратных кавычках
+func quoteClickHouseName(name string) string {
+	var sb bytes.Buffer
+	sb.WriteByte('`')
+	for _, c := range []byte(name) {
+		if c == '`' || c == '\\' {
+			sb.WriteByte('\\')
+		}
+		sb.WriteByte(c)
+	}
+	sb.WriteByte('`')
+	return sb.String()
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testClickHouse поддельный ClickHouse: запоминает запросы без данных и вставленные строки по таблицам.
+// Пакет со строкой, содержащей reject, отклоняется ошибкой разбора, при заданном status - все запросы.
+type testClickHouse struct {
+	mu      sync.Mutex
+	queries []string
+	rows    map[string][]string
+	reject  string
+	status  int
+}
+
+func (ch *testClickHouse) serve(w http.ResponseWriter, r *http.Request) {
+
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if ch.status != 0 {
+		w.WriteHeader(ch.status)
+		w.Write([]byte("Code: 202. DB::Exception: Too many simultaneous queries"))
+		return
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+	query := r.URL.Query().Get("query")
+	if query == "" {
+		ch.queries = append(ch.queries, string(body))
+		return
+	}
+
+	// INSERT INTO `db`.`table` FORMAT JSONEachRow
+	table := strings.Trim(strings.Split(strings.Fields(query)[2], ".")[1], "`")
+	if ch.reject != "" && bytes.Contains(body, []byte(ch.reject)) {
+		w.Header().Set("X-ClickHouse-Exception-Code", "27")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Code: 27. DB::Exception: Cannot parse input"))
+		return
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+		ch.rows[table] = append(ch.rows[table], line)
+	}
+}
+
+func TestClickHouseOutputTables(t *testing.T) {
+
+	ch := &testClickHouse{rows: make(map[string][]string)}
+	server := newTestServer(t, ch.serve)
+	config := newTestConfig(t, outputConf{Type: outputClickHouse, Name: "ch", URL: server.URL, BulkSize: defaultOutputBulkSize})
+	o := newClickHouseOutput(config, config.outputs[0])
+
+	events := []*outputEvent{
+		{Name: "CONN", ID: "1", Document: []byte(`{"@timestamp":"2024-01-02T03:04:05.000001+03:00","event_techlog":"CONN"}`)},
+		{Name: "MEM", ID: "2", Document: []byte(`{"@timestamp":"2024-01-02T03:04:06.000001+03:00","event_techlog":"MEM","sz":1}`)},
+		{Name: "LEAKS", ID: "3", Document: []byte(`{"@timestamp":"2024-01-02T03:04:07.000001+03:00","event_techlog":"LEAKS"}`)},
+	}
+	for _, event := range events {
+		if err := o.send(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := o.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// таблица события с картой создается по карте, события без карты - в общей таблице
+	var created []string
+	for _, query := range ch.queries {
+		if strings.HasPrefix(query, "CREATE TABLE") {
+			created = append(created, strings.SplitN(query, "\n", 2)[0])
+		}
+	}
+	sort.Strings(created)
+	want := []string{
+		"CREATE TABLE IF NOT EXISTS `default`.`tech_journal_conn` (",
+		"CREATE TABLE IF NOT EXISTS `default`.`tech_journal_other` (",
+	}
+	if !reflect.DeepEqual(created, want) {
+		t.Errorf("created %q, want %q", created, want)
+	}
+	for _, query := range ch.queries {
+		if strings.Contains(query, "tech_journal_other") && strings.HasPrefix(query, "CREATE TABLE") &&
+			!strings.Contains(query, "`document` String") {
+			t.Errorf("fallback table without document column: %s", query)
+		}
+	}
+
+	if len(ch.rows["tech_journal_conn"]) != 1 {
+		t.Errorf("tech_journal_conn rows %q", ch.rows["tech_journal_conn"])
+	}
+	other := ch.rows["tech_journal_other"]
+	if len(other) != 2 || !strings.Contains(other[0], `"event_techlog":"MEM"`) ||
+		!strings.Contains(other[0], `"document":"{\"@timestamp\"`) ||
+		!strings.Contains(other[0], `"@timestamp":"2024-01-02T03:04:06.000001+03:00"`) {
+		t.Errorf("tech_journal_other rows %q", other)
+	}
+}
+
+func TestClickHouseOutputRejectedRows(t *testing.T) {
+
+	ch := &testClickHouse{rows: make(map[string][]string), reject: "broken"}
+	server := newTestServer(t, ch.serve)
+	config := newTestConfig(t, outputConf{Type: outputClickHouse, Name: "ch", URL: server.URL, BulkSize: defaultOutputBulkSize})
+	o := newClickHouseOutput(config, config.outputs[0])
+
+	for _, id := range []string{"1", "2", "broken", "4", "5"} {
+		event := &outputEvent{Name: "CONN", ID: id, File: "rphost_1/24010203.log",
+			Document: []byte(`{"@timestamp":"2024-01-02T03:04:05.000001+03:00","id":"` + id + `"}`)}
+		if err := o.send(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := o.flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+
+	if rows := ch.rows["tech_journal_conn"]; len(rows) != 4 {
+		t.Fatalf("inserted %d rows, want 4: %q", len(rows), rows)
+	}
+	letters, err := readDeadLetters(config.DeadLetterFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 || letters[0].ID != "broken" || letters[0].Output != "ch" ||
+		letters[0].Index != "tech_journal_conn" || letters[0].ErrorType != "CANNOT_PARSE_INPUT_ASSERTION_FAILED" {
+		t.Fatalf("dead letters %+v", letters)
+	}
+
+	// после исправления данных строка вставляется повторной отправкой
+	ch.reject = ""
+	rejected, err := resendDeadLetters(config, letters)
+	if err != nil || len(rejected) != 0 {
+		t.Fatalf("resend: %v, rejected %d", err, len(rejected))
+	}
+	if rows := ch.rows["tech_journal_conn"]; len(rows) != 5 || !strings.Contains(rows[4], "broken") {
+		t.Errorf("rows after resend %q", rows)
+	}
+}
+
+func TestClickHouseOutputTransientError(t *testing.T) {
+
+	ch := &testClickHouse{rows: make(map[string][]string)}
+	server := newTestServer(t, ch.serve)
+	config := newTestConfig(t, outputConf{Type: outputClickHouse, Name: "ch", URL: server.URL, BulkSize: defaultOutputBulkSize})
+	o := newClickHouseOutput(config, config.outputs[0])
+
+	if err := o.send(&outputEvent{Name: "CONN", ID: "1", Document: []byte(`{"@timestamp":"2024-01-02T03:04:05+03:00"}`)}); err != nil {
+		t.Fatal(err)
+	}
+	ch.status = http.StatusServiceUnavailable
+	if err := o.flush(); err == nil {
+		t.Fatal("flush: want error")
+	}
+	if letters, _ := readDeadLetters(config.DeadLetterFile); len(letters) != 0 {
+		t.Errorf("dead letters %+v", letters)
+	}
+}
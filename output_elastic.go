@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	logr "github.com/sirupsen/logrus"
+)
+
+// elasticOutput приемник Elasticsearch: bulk запросы по индексу каждого типа событий,
+// индекс создается по карте события из maps, отклоненные документы сохраняются в dead_letter
+type elasticOutput struct {
+	config  *conf
+	oc      outputConf
+	es      *elasticsearch.Client
+	mapping map[string]string
+	// буфер bulk запроса, имя события и файл тех журнала первого документа буфера по индексу
+	buffers map[string]*bytes.Buffer
+	events  map[string]string
+	files   map[string]string
+}
+
+func newElasticOutput(config *conf, oc outputConf) (*elasticOutput, error) {
+
+	es, err := createElasticsearchClient(getElasticConf(config, oc))
+	if err != nil {
+		return nil, err
+	}
+	return &elasticOutput{
+		config:  config,
+		oc:      oc,
+		es:      es,
+		mapping: getMappings(),
+		buffers: make(map[string]*bytes.Buffer),
+		events:  make(map[string]string),
+		files:   make(map[string]string),
+	}, nil
+}
+
+// getElasticConf параметры подключения приемника: адрес и учетные данные приемника вместо elastic_*
+func getElasticConf(config *conf, oc outputConf) *conf {
+	c := *config
+	c.ElasticAddr = oc.URL
+	c.ElasticLogin = oc.Login
+	c.ElasticPassword = oc.Password
+	return &c
+}
+
+func (o *elasticOutput) send(event *outputEvent) error {
+
+	template := o.oc.Index
+	if template == "" {
+		template = event.Source.ElasticIndx
+	}
+	idxName := getOutputName(template, event.Name)
+
+	buf := o.buffers[idxName]
+	if buf == nil {
+		buf = new(bytes.Buffer)
+		o.buffers[idxName] = buf
+		o.events[idxName] = event.Name
+	}
+	if buf.Len() == 0 {
+		o.files[idxName] = event.File
+	}
+
+	// заголовок + source события
+	meta := []byte(fmt.Sprintf(`{ "index" : { "_index" : "%s","_id" : "%s" } }%s`, idxName, event.ID, "\n"))
+	buf.Grow(len(meta) + len(event.Document) + 1)
+	buf.Write(meta)
+	buf.Write(event.Document)
+	buf.WriteString("\n")
+
+	if int64(buf.Len()) >= o.oc.BulkSize {
+		return o.sendBulk(idxName)
+	}
+	return nil
+}
+
+func (o *elasticOutput) flush() error {
+	for idxName := range o.buffers {
+		if err := o.sendBulk(idxName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *elasticOutput) sendBulk(idxName string) error {
+
+	buf := o.buffers[idxName]
+	if buf.Len() == 0 {
+		return nil
+	}
+	event := o.events[idxName]
+	file := o.files[idxName]
+
+	if err := ensureIndex(o.es, idxName, o.mapping[strings.ToLower(event)]); err != nil {
+		return fmt.Errorf("cannot create index %s: %v", idxName, err)
+	}
+
+	// 0.11. отправляем в эластик
+	rejections, err := executeBulk(o.es, idxName, buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("failure indexing batch %s: %v", idxName, err)
+	}
+
+	// Успешный ответ может по-прежнему содержать ошибки для определенных документов,
+	// отклоненные документы сохраняются в приемник dead_letter
+	var letters []*deadLetter
+	for _, r := range rejections {
+		logr.WithFields(logr.Fields{
+			"object": "Elastic",
+			"title":  "Request",
+		}).Errorf("[%d]: %s: %s: %s: %s (%s)",
+			r.Status,
+			r.ErrorType,
+			r.ErrorReason,
+			r.CauseType,
+			r.CauseReason,
+			file,
+		)
+		letters = append(letters, newDeadLetter(r, o.oc.Name, idxName, event, file))
+	}
+
+	if err := o.config.deadLetters.write(letters); err != nil {
+		return fmt.Errorf("failure to save rejected documents: %v", err)
+	}
+
+	buf.Reset()
+	return nil
+}
+
+// bulkDocument документ bulk запроса: строка заголовка и строка документа
+type bulkDocument struct {
+	ID     string
+	Meta   []byte
+	Source []byte
+}
+
+// bulkRejection отказ в индексации документа bulk запроса
+type bulkRejection struct {
+	Document    bulkDocument
+	Status      int
+	ErrorType   string
+	ErrorReason string
+	CauseType   string
+	CauseReason string
+}
+
+// splitBulk разбирает тело bulk запроса на документы в порядке запроса
+func splitBulk(body []byte) []bulkDocument {
+
+	var docs []bulkDocument
+	lines := bytes.Split(bytes.TrimRight(body, "\n"), []byte("\n"))
+	for i := 0; i+1 < len(lines); i += 2 {
+		var meta struct {
+			Index struct {
+				ID string `json:"_id"`
+			} `json:"index"`
+		}
+		json.Unmarshal(lines[i], &meta)
+		docs = append(docs, bulkDocument{ID: meta.Index.ID, Meta: lines[i], Source: lines[i+1]})
+	}
+	return docs
+}
+
+// joinBulk собирает тело bulk запроса из документов
+func joinBulk(docs []bulkDocument) []byte {
+	var buf bytes.Buffer
+	for _, doc := range docs {
+		buf.Write(doc.Meta)
+		buf.WriteString("\n")
+		buf.Write(doc.Source)
+		buf.WriteString("\n")
+	}
+	return buf.Bytes()
+}
+
+// isTransientStatus код ответа временной ошибки: Elasticsearch перегружен или недоступен,
+// документ будет принят при повторной отправке
+func isTransientStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+}
+
+// executeBulk отправляет bulk запрос и возвращает отказы по документам. i-й элемент ответа
+// соответствует i-му документу запроса. Отказами возвращаются только постоянные ошибки документов
+// (конфликт с картой индекса, ошибка разбора), они не исчезнут при повторной отправке. Ошибка всего запроса
+// и временные ошибки документов (429, 5xx - Elasticsearch перегружен) возвращаются ошибкой, пакет будет
+// отправлен повторно. Слишком большой запрос (413) делится пополам, отказом считается только документ,
+// который не помещается в запрос один.
+func executeBulk(es *elasticsearch.Client, idxName string, body []byte) ([]*bulkRejection, error) {
+
+	docs := splitBulk(body)
+
+	res, err := es.Bulk(
+		bytes.NewReader(body),
+		es.Bulk.WithIndex(idxName),
+		es.Bulk.WithRefresh("false"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	// Закрываем тело ответа, чтобы предотвратить достижение предела для горутин или дескрипторов файлов.
+	defer res.Body.Close()
+
+	if res.IsError() {
+		var raw map[string]interface{}
+		json.NewDecoder(res.Body).Decode(&raw)
+		errType, reason := getResponseError(raw["error"])
+
+		if res.StatusCode != http.StatusRequestEntityTooLarge {
+			return nil, fmt.Errorf("[%d] %s: %s", res.StatusCode, errType, reason)
+		}
+		if len(docs) == 1 {
+			return []*bulkRejection{{
+				Document:    docs[0],
+				Status:      res.StatusCode,
+				ErrorType:   errType,
+				ErrorReason: reason,
+			}}, nil
+		}
+		half := len(docs) / 2
+		rejections, err := executeBulk(es, idxName, joinBulk(docs[:half]))
+		if err != nil {
+			return nil, err
+		}
+		rest, err := executeBulk(es, idxName, joinBulk(docs[half:]))
+		if err != nil {
+			return nil, err
+		}
+		return append(rejections, rest...), nil
+	}
+
+	var blk bulkResponse
+	if err := json.NewDecoder(res.Body).Decode(&blk); err != nil {
+		return nil, fmt.Errorf("failure to parse response body: %v", err)
+	}
+	if len(blk.Items) != len(docs) {
+		return nil, fmt.Errorf("bulk response has %d items for %d documents", len(blk.Items), len(docs))
+	}
+
+	var rejections []*bulkRejection
+	for i, d := range blk.Items {
+		if d.Index.Status <= 201 {
+			continue
+		}
+		if isTransientStatus(d.Index.Status) {
+			return nil, fmt.Errorf("[%d] %s: %s (%s)", d.Index.Status, d.Index.Error.Type, d.Index.Error.Reason, docs[i].ID)
+		}
+		rejections = append(rejections, &bulkRejection{
+			Document:    docs[i],
+			Status:      d.Index.Status,
+			ErrorType:   d.Index.Error.Type,
+			ErrorReason: d.Index.Error.Reason,
+			CauseType:   d.Index.Error.Cause.Type,
+			CauseReason: d.Index.Error.Cause.Reason,
+		})
+	}
+	return rejections, nil
+}
+
+// getResponseError тип и причина ошибки запроса: объект {"type", "reason"} или строка
+func getResponseError(value interface{}) (string, string) {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		errType, _ := value["type"].(string)
+		reason, _ := value["reason"].(string)
+		return errType, reason
+	case string:
+		return "", value
+	}
+	return "", ""
+}
+
+// newDeadLetter запись об отклоненном документе
+func newDeadLetter(r *bulkRejection, output string, idxName string, event string, sourceFile string) *deadLetter {
+	return &deadLetter{
+		Time:        time.Now().Format(eventDateFormat),
+		Output:      output,
+		Index:       idxName,
+		ID:          r.Document.ID,
+		Event:       event,
+		SourceFile:  sourceFile,
+		Status:      r.Status,
+		ErrorType:   r.ErrorType,
+		ErrorReason: r.ErrorReason,
+		CauseType:   r.CauseType,
+		CauseReason: r.CauseReason,
+		Document:    string(r.Document.Source),
+	}
+}
+
+// getDeadLetterOutput приемник Elasticsearch отклоненного документа: приемник с именем name, а если его нет
+// (документ отклонен приемником, переименованным или удаленным из настроек) - первый приемник Elasticsearch
+func (c *conf) getDeadLetterOutput(name string) (outputConf, error) {
+
+	var first *outputConf
+	for i := range c.outputs {
+		oc := &c.outputs[i]
+		if oc.Type != outputElastic {
+			continue
+		}
+		if oc.Name == name {
+			return *oc, nil
+		}
+		if first == nil {
+			first = oc
+		}
+	}
+	if first == nil {
+		return outputConf{}, fmt.Errorf("no elasticsearch output for rejected documents")
+	}
+	return *first, nil
+}
+
+// groupDeadLetters группирует отклоненные документы по приемникам Elasticsearch в порядке появления
+func (c *conf) groupDeadLetters(letters []*deadLetter) (map[string][]*deadLetter, []outputConf, error) {
+
+	byOutput := make(map[string][]*deadLetter)
+	var outputs []outputConf
+	for _, letter := range letters {
+		oc, err := c.getDeadLetterOutput(letter.Output)
+		if err != nil {
+			return nil, nil, err
+		}
+		if byOutput[oc.Name] == nil {
+			outputs = append(outputs, oc)
+		}
+		byOutput[oc.Name] = append(byOutput[oc.Name], letter)
+	}
+	return byOutput, outputs, nil
+}
+
+// ensureIndex создает индекс по карте, если его еще нет
+func ensureIndex(es *elasticsearch.Client, idxName string, mapping string) error {
+
+	res, err := es.Indices.Exists([]string{idxName})
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != 404 {
+		return nil
+	}
+
+	res, err = es.Indices.Create(
+		idxName,
+		es.Indices.Create.WithBody(strings.NewReader(mapping)),
+		es.Indices.Create.WithWaitForActiveShards("1"),
+		es.Indices.Create.WithTimeout(60),
+	)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// resendElasticDeadLetters отправляет документы в исходные индексы кластера приемника, отклонившего документ,
+// пакетами bulk_size приемника и возвращает снова отклоненные документы с новой причиной отказа.
+// Отсутствующий индекс создается по карте события.
+func resendElasticDeadLetters(config *conf, letters []*deadLetter) ([]*deadLetter, error) {
+
+	var rejected []*deadLetter
+	byOutput, outputs, err := config.groupDeadLetters(letters)
+	if err != nil {
+		return nil, err
+	}
+	mapping := getMappings()
+
+	for _, oc := range outputs {
+
+		es, err := createElasticsearchClient(getElasticConf(config, oc))
+		if err != nil {
+			return nil, err
+		}
+
+		byIndex := make(map[string][]*deadLetter)
+		var indices []string
+		for _, letter := range byOutput[oc.Name] {
+			if byIndex[letter.Index] == nil {
+				indices = append(indices, letter.Index)
+			}
+			byIndex[letter.Index] = append(byIndex[letter.Index], letter)
+		}
+
+		for _, idxName := range indices {
+
+			group := byIndex[idxName]
+			if err := ensureIndex(es, idxName, mapping[strings.ToLower(group[0].Event)]); err != nil {
+				return nil, err
+			}
+
+			send := func(buf *bytes.Buffer, batch map[string]*deadLetter) error {
+				rejections, err := executeBulk(es, idxName, buf.Bytes())
+				if err != nil {
+					return err
+				}
+				for _, r := range rejections {
+					letter := batch[r.Document.ID]
+					rejected = append(rejected, newDeadLetter(r, oc.Name, idxName, letter.Event, letter.SourceFile))
+				}
+				buf.Reset()
+				return nil
+			}
+
+			var buf bytes.Buffer
+			batch := make(map[string]*deadLetter)
+			for _, letter := range group {
+				buf.WriteString(fmt.Sprintf(`{ "index" : { "_index" : "%s","_id" : "%s" } }%s`, idxName, letter.ID, "\n"))
+				buf.WriteString(letter.Document)
+				buf.WriteString("\n")
+				batch[letter.ID] = letter
+
+				if int64(buf.Len()) >= oc.BulkSize {
+					if err := send(&buf, batch); err != nil {
+						return nil, err
+					}
+					batch = make(map[string]*deadLetter)
+				}
+			}
+			if buf.Len() > 0 {
+				if err := send(&buf, batch); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return rejected, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+// writeBulkResponse ответ bulk запроса с кодом status для каждого документа
+func writeBulkResponse(w http.ResponseWriter, statuses []int) {
+	var items []map[string]interface{}
+	for _, status := range statuses {
+		item := map[string]interface{}{"status": status}
+		if status > 201 {
+			item["error"] = map[string]interface{}{"type": fmt.Sprintf("error_%d", status), "reason": "test"}
+		}
+		items = append(items, map[string]interface{}{"index": item})
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"errors": true, "items": items})
+}
+
+func TestExecuteBulk(t *testing.T) {
+
+	tests := []struct {
+		name string
+		docs int
+		bulk func(w http.ResponseWriter, docs []bulkDocument)
+		// rejected идентификаторы отклоненных документов, err - ожидается ошибка запроса
+		rejected []string
+		err      bool
+	}{
+		{
+			name: "accepted",
+			docs: 2,
+			bulk: func(w http.ResponseWriter, docs []bulkDocument) { writeBulkResponse(w, []int{201, 200}) },
+		},
+		{
+			name:     "mapping error is rejected",
+			docs:     3,
+			bulk:     func(w http.ResponseWriter, docs []bulkDocument) { writeBulkResponse(w, []int{201, 400, 201}) },
+			rejected: []string{"2"},
+		},
+		{
+			name: "item 429 is retried",
+			docs: 2,
+			bulk: func(w http.ResponseWriter, docs []bulkDocument) { writeBulkResponse(w, []int{400, 429}) },
+			err:  true,
+		},
+		{
+			name: "request 503 is retried",
+			docs: 2,
+			bulk: func(w http.ResponseWriter, docs []bulkDocument) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				w.Write([]byte(`{"error":{"type":"unavailable","reason":"test"}}`))
+			},
+			err: true,
+		},
+		{
+			name: "request 413 is split",
+			docs: 4,
+			bulk: func(w http.ResponseWriter, docs []bulkDocument) {
+				// документ 3 слишком большой, запрос больше одного документа - тоже
+				if len(docs) > 1 || docs[0].ID == "3" {
+					w.WriteHeader(http.StatusRequestEntityTooLarge)
+					w.Write([]byte(`{"error":"too large"}`))
+					return
+				}
+				writeBulkResponse(w, []int{201})
+			},
+			rejected: []string{"3"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-Elastic-Product", "Elasticsearch")
+				w.Header().Set("Content-Type", "application/json")
+				body, _ := ioutil.ReadAll(r.Body)
+				tt.bulk(w, splitBulk(body))
+			})
+
+			es, err := createElasticsearchClient(&conf{ElasticAddr: server.URL, ElasticMaxRetrires: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var body bytes.Buffer
+			for i := 1; i <= tt.docs; i++ {
+				fmt.Fprintf(&body, "{ \"index\" : { \"_index\" : \"test\",\"_id\" : \"%d\" } }\n{\"n\":%d}\n", i, i)
+			}
+			rejections, err := executeBulk(es, "test", body.Bytes())
+			if (err != nil) != tt.err {
+				t.Fatalf("error = %v, want error %v", err, tt.err)
+			}
+			var rejected []string
+			for _, r := range rejections {
+				rejected = append(rejected, r.Document.ID)
+			}
+			if fmt.Sprint(rejected) != fmt.Sprint(tt.rejected) {
+				t.Errorf("rejected %v, want %v", rejected, tt.rejected)
+			}
+		})
+	}
+}
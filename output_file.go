@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// fileOutputMu запись в файлы NDJSON из параллельных заданий
+var fileOutputMu sync.Mutex
+
+// fileOutput приемник файлов NDJSON: документ события - одна строка файла по шаблону path
+type fileOutput struct {
+	oc      outputConf
+	batches *outputBatches
+}
+
+func newFileOutput(oc outputConf) *fileOutput {
+	o := &fileOutput{oc: oc}
+	o.batches = newOutputBatches(oc.BulkSize, o.write)
+	return o
+}
+
+func (o *fileOutput) send(event *outputEvent) error {
+	return o.batches.add(getOutputPath(o.oc.Path, event.Name), event)
+}
+
+// getOutputPath путь файла по шаблону: {event} заменяется во всем пути, а дата - только в имени файла,
+// чтобы не изменились каталоги, в именах которых встречаются yyyy, MM, dd, hh (например, /var/log/1C/MMS)
+func getOutputPath(template string, event string) string {
+	dir, name := filepath.Split(template)
+	return strings.Replace(dir, "{event}", strings.ToLower(event), -1) + getOutputName(name, event)
+}
+
+func (o *fileOutput) flush() error {
+	return o.batches.flush()
+}
+
+// write дописывает пакет в файл, каталог файла создается при необходимости
+func (o *fileOutput) write(path string, event string, body []byte) error {
+
+	fileOutputMu.Lock()
+	defer fileOutputMu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(body); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	logr "github.com/sirupsen/logrus"
+)
+
+// шаблон топика Kafka по умолчанию
+const defaultKafkaTopic = "tech_journal_{event}"
+
+// максимальный размер сообщения Kafka по умолчанию, как message.max.bytes брокера
+const defaultKafkaMaxMessageBytes = 1000000
+
+// ключи сообщений Kafka
+const (
+	kafkaKeyEvent         = "event"
+	kafkaKeyProcessNameID = "processNameID"
+)
+
+// kafkaWriters клиенты Kafka по настройкам приемника. Клиент общий для всех заданий и проходов
+// парсера: он потокобезопасен и держит соединения с брокерами.
+var (
+	kafkaWriters   = make(map[string]*kafka.Writer)
+	kafkaWritersMu sync.Mutex
+)
+
+// kafkaOutput приемник Kafka: документ события - сообщение в топик по шаблону topic с ключом
+// по имени события или processNameID. Пакет отправляется синхронно с подтверждением всех реплик
+// (acks=all), поэтому позиция файла сохраняется только после подтверждения сообщений брокером.
+type kafkaOutput struct {
+	config   *conf
+	oc       outputConf
+	writer   *kafka.Writer
+	messages []kafka.Message
+	size     int64
+}
+
+func newKafkaOutput(config *conf, oc outputConf) *kafkaOutput {
+	return &kafkaOutput{config: config, oc: oc, writer: getKafkaWriter(config, oc)}
+}
+
+// getKafkaWriter возвращает клиент Kafka для настроек приемника, создавая его при первом обращении
+func getKafkaWriter(config *conf, oc outputConf) *kafka.Writer {
+
+	key := fmt.Sprint(oc)
+
+	kafkaWritersMu.Lock()
+	defer kafkaWritersMu.Unlock()
+
+	if writer, ok := kafkaWriters[key]; ok {
+		return writer
+	}
+
+	transport := &kafka.Transport{
+		DialTimeout: time.Second * time.Duration(oc.Timeout),
+	}
+	if oc.TLS {
+		transport.TLS = &tls.Config{
+			InsecureSkipVerify: config.InsecureSkipVerify,
+		}
+	}
+	if oc.Login != "" {
+		transport.SASL = plain.Mechanism{Username: oc.Login, Password: oc.Password}
+	}
+
+	writer := &kafka.Writer{
+		Addr:         kafka.TCP(oc.Brokers...),
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+		// пакет передается одним вызовом WriteMessages, ждать его наполнения не нужно
+		BatchSize:              10000,
+		BatchBytes:             int64(oc.MaxMessageBytes),
+		BatchTimeout:           10 * time.Millisecond,
+		WriteTimeout:           time.Second * time.Duration(oc.Timeout),
+		Compression:            getKafkaCompression(oc.Compression),
+		Transport:              transport,
+		AllowAutoTopicCreation: true,
+	}
+	kafkaWriters[key] = writer
+	return writer
+}
+
+// closeKafkaWriters отправляет сообщения, оставшиеся в клиентах Kafka, и закрывает соединения с брокерами.
+// Вызывается при завершении парсера, после завершения всех заданий.
+func closeKafkaWriters() {
+
+	kafkaWritersMu.Lock()
+	defer kafkaWritersMu.Unlock()
+
+	for key, writer := range kafkaWriters {
+		if err := writer.Close(); err != nil {
+			logr.WithFields(logr.Fields{
+				"object": "Kafka",
+				"title":  "Failure to close writer",
+			}).Warning(err)
+		}
+		delete(kafkaWriters, key)
+	}
+}
+
+// getKafkaCompression сжатие сообщений: gzip, snappy, lz4, zstd, пусто - без сжатия
+func getKafkaCompression(name string) kafka.Compression {
+	switch strings.ToLower(name) {
+	case "gzip":
+		return kafka.Gzip
+	case "snappy":
+		return kafka.Snappy
+	case "lz4":
+		return kafka.Lz4
+	case "zstd":
+		return kafka.Zstd
+	}
+	return 0
+}
+
+// checkKafkaConf проверяет настройки приемника Kafka и заполняет незаданные значения
+func checkKafkaConf(oc *outputConf) error {
+
+	if len(oc.Brokers) == 0 {
+		return fmt.Errorf("brokers are required")
+	}
+	if oc.Topic == "" {
+		oc.Topic = defaultKafkaTopic
+	}
+	if oc.Key == "" {
+		oc.Key = kafkaKeyEvent
+	}
+	if oc.Key != kafkaKeyEvent && oc.Key != kafkaKeyProcessNameID {
+		return fmt.Errorf("unknown key %q", oc.Key)
+	}
+	if oc.MaxMessageBytes <= 0 {
+		oc.MaxMessageBytes = defaultKafkaMaxMessageBytes
+	}
+	switch strings.ToLower(oc.Compression) {
+	case "", "gzip", "snappy", "lz4", "zstd":
+	default:
+		return fmt.Errorf("unknown compression %q", oc.Compression)
+	}
+	return nil
+}
+
+func (o *kafkaOutput) send(event *outputEvent) error {
+
+	key := event.Name
+	if o.oc.Key == kafkaKeyProcessNameID {
+		key = event.ProcessNameID
+	}
+	message := newKafkaMessage(getOutputName(o.oc.Topic, event.Name), key, event)
+
+	// брокер не примет сообщение больше message.max.bytes, а повторная отправка файла
+	// не изменит размер события, поэтому сообщение сохраняется в приемник dead_letter
+	if letter := o.checkSize(message, event); letter != nil {
+		logr.WithFields(logr.Fields{
+			"object": "Kafka",
+			"title":  "Message too large",
+			"file":   event.File,
+		}).Errorf("%s %s: %s", event.Name, event.ID, letter.ErrorReason)
+		if err := o.config.deadLetters.write([]*deadLetter{letter}); err != nil {
+			return fmt.Errorf("failure to save rejected documents: %v", err)
+		}
+		return nil
+	}
+
+	o.messages = append(o.messages, message)
+	o.size += int64(len(message.Value))
+
+	if o.size >= o.oc.BulkSize {
+		return o.flush()
+	}
+	return nil
+}
+
+// newKafkaMessage сообщение документа события с ключом key
+func newKafkaMessage(topic string, key string, event *outputEvent) kafka.Message {
+	return kafka.Message{
+		Topic: topic,
+		Key:   []byte(key),
+		Value: event.Document,
+		Headers: []kafka.Header{
+			{Key: "event", Value: []byte(event.Name)},
+			{Key: "id", Value: []byte(event.ID)},
+		},
+	}
+}
+
+// checkSize запись для приемника dead_letter, если сообщение больше max_message_bytes, иначе nil
+func (o *kafkaOutput) checkSize(message kafka.Message, event *outputEvent) *deadLetter {
+
+	size := len(message.Key) + len(message.Value)
+	if size <= o.oc.MaxMessageBytes {
+		return nil
+	}
+	return &deadLetter{
+		Time:        time.Now().Format(eventDateFormat),
+		Output:      o.oc.Name,
+		Index:       message.Topic,
+		ID:          event.ID,
+		Key:         string(message.Key),
+		Event:       event.Name,
+		SourceFile:  event.File,
+		Status:      http.StatusRequestEntityTooLarge,
+		ErrorType:   "message_too_large",
+		ErrorReason: fmt.Sprintf("%d bytes, max_message_bytes %d", size, o.oc.MaxMessageBytes),
+		Document:    string(event.Document),
+	}
+}
+
+// resendKafkaDeadLetters отправляет сохраненные сообщения в их топики, например после увеличения
+// max_message_bytes, и возвращает сообщения, которые по-прежнему больше max_message_bytes
+func resendKafkaDeadLetters(config *conf, oc outputConf, letters []*deadLetter) ([]*deadLetter, error) {
+
+	o := newKafkaOutput(config, oc)
+
+	var rejected []*deadLetter
+	for _, letter := range letters {
+		event := &outputEvent{
+			Name:     letter.Event,
+			ID:       letter.ID,
+			File:     letter.SourceFile,
+			Document: []byte(letter.Document),
+		}
+		message := newKafkaMessage(letter.Index, letter.Key, event)
+		if rejection := o.checkSize(message, event); rejection != nil {
+			rejected = append(rejected, rejection)
+			continue
+		}
+
+		o.messages = append(o.messages, message)
+		o.size += int64(len(message.Value))
+		if o.size >= o.oc.BulkSize {
+			if err := o.flush(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := o.flush(); err != nil {
+		return nil, err
+	}
+	return rejected, nil
+}
+
+func (o *kafkaOutput) flush() error {
+
+	if len(o.messages) == 0 {
+		return nil
+	}
+	if err := o.writer.WriteMessages(context.Background(), o.messages...); err != nil {
+		return getKafkaError(err)
+	}
+	o.messages = o.messages[:0]
+	o.size = 0
+	return nil
+}
+
+// getKafkaError первая ошибка пакета вместо списка ошибок по каждому сообщению
+func getKafkaError(err error) error {
+	if errs, ok := err.(kafka.WriteErrors); ok {
+		for _, e := range errs {
+			if e != nil {
+				return fmt.Errorf("%d of %d messages: %v", errs.Count(), len(errs), e)
+			}
+		}
+	}
+	return err
+}
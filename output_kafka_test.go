@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestKafkaOutputMessageTooLarge(t *testing.T) {
+
+	config := newTestConfig(t, outputConf{Type: outputKafka, Name: "kafka", Brokers: []string{"127.0.0.1:1"},
+		Key: kafkaKeyProcessNameID, MaxMessageBytes: 100})
+	defer closeOutputs()
+
+	o := newKafkaOutput(config, config.outputs[0])
+	small := &outputEvent{Name: "CALL", ID: "1", ProcessNameID: "rphost_1", Document: []byte(`{"n":1}`)}
+	large := &outputEvent{Name: "CALL", ID: "2", ProcessNameID: "rphost_1", File: "rphost_1/24010203.log",
+		Document: []byte(`{"context":"` + strings.Repeat("x", 200) + `"}`)}
+	for _, event := range []*outputEvent{small, large} {
+		if err := o.send(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// большое сообщение не попадает в пакет, а сохраняется в dead_letter с топиком и ключом
+	if len(o.messages) != 1 || string(o.messages[0].Value) != `{"n":1}` {
+		t.Fatalf("pending messages %d", len(o.messages))
+	}
+	letters, err := readDeadLetters(config.DeadLetterFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 || letters[0].ID != "2" || letters[0].Output != "kafka" || letters[0].Index != "tech_journal_call" ||
+		letters[0].Key != "rphost_1" || letters[0].Document != string(large.Document) {
+		t.Fatalf("dead letters %+v", letters)
+	}
+
+	// сообщение, которое по-прежнему больше max_message_bytes, остается отклоненным без обращения к брокеру
+	rejected, err := resendDeadLetters(config, letters)
+	if err != nil || len(rejected) != 1 || rejected[0].ID != "2" {
+		t.Fatalf("resend: %v, rejected %+v", err, rejected)
+	}
+}
+
+func TestCloseKafkaWriters(t *testing.T) {
+
+	oc := outputConf{Type: outputKafka, Name: "kafka", Brokers: []string{"127.0.0.1:1"}}
+	if err := checkKafkaConf(&oc); err != nil {
+		t.Fatal(err)
+	}
+	getKafkaWriter(&conf{}, oc)
+	closeOutputs()
+
+	kafkaWritersMu.Lock()
+	defer kafkaWritersMu.Unlock()
+	if len(kafkaWriters) != 0 {
+		t.Errorf("%d writers left open", len(kafkaWriters))
+	}
+}
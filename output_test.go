@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestOutputFanOutPartialFailure(t *testing.T) {
+
+	elastic := &testOutput{}
+	webhook := &testOutput{err: errors.New("500 Internal Server Error")}
+	outputs := map[string]*testOutput{"elastic": elastic, "webhook": webhook}
+
+	// первое чтение: webhook недоступен, elastic принимает документы
+	fanOut := newTestFanOut(outputs, "elastic", "webhook")
+	file := &files{}
+	fanOut.begin(file)
+	fanOut.send(&outputEvent{ID: "a"}, 0)
+	fanOut.send(&outputEvent{ID: "b"}, 100)
+	fanOut.flush("test.log")
+
+	if any, all := fanOut.failed(); !any || all {
+		t.Fatalf("failed() = %v, %v, want true, false", any, all)
+	}
+	if !reflect.DeepEqual(elastic.sent, []string{"a", "b"}) {
+		t.Fatalf("elastic sent %v", elastic.sent)
+	}
+
+	var cp checkpoint
+	cp.setSent(fanOut.outputsSent(200))
+	if cp.Sent != 0 || !reflect.DeepEqual(cp.Outputs, map[string]int64{"elastic": 200}) {
+		t.Fatalf("checkpoint sent %d, outputs %v", cp.Sent, cp.Outputs)
+	}
+
+	// повторное чтение с прежней позиции: документы получает только webhook
+	webhook.err = nil
+	fanOut = newTestFanOut(outputs, "elastic", "webhook")
+	file = &files{Sent: cp.Sent, OutputsSent: cp.Outputs}
+	fanOut.begin(file)
+	fanOut.send(&outputEvent{ID: "a"}, 0)
+	fanOut.send(&outputEvent{ID: "b"}, 100)
+	fanOut.send(&outputEvent{ID: "c"}, 200)
+	fanOut.flush("test.log")
+
+	if any, _ := fanOut.failed(); any {
+		t.Fatalf("unexpected failure: %v", fanOut.err())
+	}
+	if !reflect.DeepEqual(elastic.sent, []string{"a", "b", "c"}) {
+		t.Errorf("elastic sent %v", elastic.sent)
+	}
+	if !reflect.DeepEqual(webhook.sent, []string{"a", "b", "c"}) {
+		t.Errorf("webhook sent %v", webhook.sent)
+	}
+
+	cp = checkpoint{Position: 300}
+	cp.setSent(fanOut.outputsSent(300))
+	if cp.Sent != 0 || cp.Outputs != nil {
+		t.Errorf("checkpoint sent %d, outputs %v", cp.Sent, cp.Outputs)
+	}
+}
+
+func TestCheckpointSetSent(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		position int64
+		outputs  map[string]int64
+		sent     int64
+		perOut   map[string]int64
+	}{
+		{"all at position", 100, map[string]int64{"a": 100, "b": 100}, 0, nil},
+		{"held by correlation", 50, map[string]int64{"a": 100, "b": 100}, 100, nil},
+		{"one output behind", 0, map[string]int64{"a": 100, "b": 0}, 0, map[string]int64{"a": 100}},
+		{"one output ahead", 50, map[string]int64{"a": 200, "b": 100}, 100, map[string]int64{"a": 200}},
+	}
+
+	for _, tt := range tests {
+		cp := checkpoint{Position: tt.position}
+		cp.setSent(tt.outputs)
+		if cp.Sent != tt.sent || !reflect.DeepEqual(cp.Outputs, tt.perOut) {
+			t.Errorf("%s: sent %d, outputs %v, want %d, %v", tt.name, cp.Sent, cp.Outputs, tt.sent, tt.perOut)
+		}
+	}
+}
+
+func TestGetOutputPath(t *testing.T) {
+
+	year := strconv.Itoa(time.Now().Year())
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{"/data/{event}/{event}_yyyy.ndjson", "/data/conn/conn_" + year + ".ndjson"},
+		{"/data/yyyy-archive/MM/{event}.ndjson", "/data/yyyy-archive/MM/conn.ndjson"},
+		{"{event}.ndjson", "conn.ndjson"},
+	}
+	for _, tt := range tests {
+		if got := getOutputPath(filepath.FromSlash(tt.template), "CONN"); got != filepath.FromSlash(tt.want) {
+			t.Errorf("getOutputPath(%q) = %q, want %q", tt.template, got, tt.want)
+		}
+	}
+}
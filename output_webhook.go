@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// webhookOutput приемник HTTP: пакеты документов отправляются POST запросом в формате NDJSON,
+// например в Logstash, Vector или Fluent Bit, которые передают события в OpenSearch, Loki и т.п.
+type webhookOutput struct {
+	oc      outputConf
+	client  *http.Client
+	batches *outputBatches
+}
+
+func newWebhookOutput(config *conf, oc outputConf) *webhookOutput {
+	o := &webhookOutput{oc: oc, client: newOutputHTTPClient(config, oc)}
+	o.batches = newOutputBatches(oc.BulkSize, o.write)
+	return o
+}
+
+func (o *webhookOutput) send(event *outputEvent) error {
+	return o.batches.add("", event)
+}
+
+func (o *webhookOutput) flush() error {
+	return o.batches.flush()
+}
+
+func (o *webhookOutput) write(name string, event string, body []byte) error {
+
+	req, err := http.NewRequest(http.MethodPost, o.oc.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if o.oc.Login != "" {
+		req.SetBasicAuth(o.oc.Login, o.oc.Password)
+	}
+	for key, value := range o.oc.Headers {
+		req.Header.Set(key, value)
+	}
+
+	return doOutputRequest(o.client, req)
+}
+
+// doOutputRequest выполняет запрос приемника, ответ с кодом не 2xx - ошибка с текстом ответа
+func doOutputRequest(client *http.Client, req *http.Request) error {
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		text, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("%s: %s: %s", req.URL.Redacted(), res.Status, bytes.TrimSpace(text))
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// Запись файлов Apache Parquet для команды convert библиотекой parquet-go: плоская схема из необязательных
+// колонок строк (STRING), целых (INT64) и времени (TIMESTAMP в микросекундах, UTC), сжатие Snappy.
+
+// типы колонок parquet
+const (
+	parquetString = iota
+	parquetInt64
+	parquetTimestamp
+)
+
+// число строк группы строк parquet
+const parquetRowGroupSize = 100000
+
+// parquetColumn колонка файла parquet
+type parquetColumn struct {
+	Name string
+	Type int
+}
+
+// parquetValue значение колонки строки: nil - пустое значение, string, int64 (целое или время в микросекундах)
+type parquetValue interface{}
+
+// parquetWriter запись файла parquet по строкам. Колонки схемы parquet упорядочены по имени,
+// значения строки передаются в порядке колонок columns.
+type parquetWriter struct {
+	w *parquet.Writer
+	// leaves номер колонки схемы для каждой колонки columns
+	leaves []int
+	row    parquet.Row
+}
+
+func newParquetWriter(w io.Writer, columns []parquetColumn, maxRows int64) *parquetWriter {
+
+	group := make(parquet.Group, len(columns))
+	for _, column := range columns {
+		switch column.Type {
+		case parquetInt64:
+			group[column.Name] = parquet.Optional(parquet.Int(64))
+		case parquetTimestamp:
+			group[column.Name] = parquet.Optional(parquet.Timestamp(parquet.Microsecond))
+		default:
+			group[column.Name] = parquet.Optional(parquet.String())
+		}
+	}
+	schema := parquet.NewSchema("techlog", group)
+
+	pw := &parquetWriter{
+		w:      parquet.NewWriter(w, schema, parquet.MaxRowsPerRowGroup(maxRows), parquet.Compression(&parquet.Snappy)),
+		leaves: make([]int, len(columns)),
+		row:    make(parquet.Row, len(columns)),
+	}
+	for i, column := range columns {
+		leaf, _ := schema.Lookup(column.Name)
+		pw.leaves[i] = leaf.ColumnIndex
+	}
+	return pw
+}
+
+// write добавляет строку, значения в порядке колонок
+func (pw *parquetWriter) write(row []parquetValue) error {
+
+	for i, value := range row {
+		leaf := pw.leaves[i]
+		switch value := value.(type) {
+		case string, int64:
+			pw.row[leaf] = parquet.ValueOf(value).Level(0, 1, leaf)
+		default:
+			pw.row[leaf] = parquet.NullValue().Level(0, 0, leaf)
+		}
+	}
+	_, err := pw.w.WriteRows([]parquet.Row{pw.row})
+	return err
+}
+
+// close записывает последнюю группу строк и метаданные файла
+func (pw *parquetWriter) close() error {
+	return pw.w.Close()
+}
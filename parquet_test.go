@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+func TestParquetRoundTrip(t *testing.T) {
+
+	var columns []parquetColumn
+	for i := 0; i < 17; i++ {
+		columns = append(columns, parquetColumn{Name: fmt.Sprintf("col%02d", 16-i), Type: i % 3})
+	}
+
+	var rows [][]parquetValue
+	for i := 0; i < 250; i++ {
+		row := make([]parquetValue, len(columns))
+		for c, column := range columns {
+			// серии пустых значений разной длины, колонка 1 пуста целиком, колонка 0 заполнена
+			if c == 1 || c > 1 && (i/(c+2))%3 == 0 {
+				continue
+			}
+			switch column.Type {
+			case parquetString:
+				row[c] = fmt.Sprintf("значение %d/%d", i, c)
+			case parquetInt64:
+				row[c] = int64(i*100 - c)
+			case parquetTimestamp:
+				row[c] = int64(1704164645000000 + i*1000 + c)
+			}
+		}
+		rows = append(rows, row)
+	}
+
+	var buf bytes.Buffer
+	pw := newParquetWriter(&buf, columns, 100)
+	for _, row := range rows {
+		if err := pw.write(row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pw.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := parquet.OpenFile(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// типы колонок в схеме файла
+	wantTypes := map[int]string{parquetString: "STRING", parquetInt64: "INT(64,true)", parquetTimestamp: "TIMESTAMP(isAdjustedToUTC=true,unit=MICROS)"}
+	leaves := make([]int, len(columns))
+	for c, column := range columns {
+		leaf, ok := file.Schema().Lookup(column.Name)
+		if !ok {
+			t.Fatalf("no column %s", column.Name)
+		}
+		if !leaf.Node.Optional() || leaf.Node.Type().LogicalType().String() != wantTypes[column.Type] {
+			t.Errorf("column %s: optional %v, type %s", column.Name, leaf.Node.Optional(), leaf.Node.Type().LogicalType())
+		}
+		leaves[c] = leaf.ColumnIndex
+	}
+
+	var groups []int64
+	for _, rg := range file.RowGroups() {
+		groups = append(groups, rg.NumRows())
+	}
+	if fmt.Sprint(groups) != "[100 100 50]" {
+		t.Errorf("row groups %v", groups)
+	}
+
+	reader := parquet.NewReader(file)
+	read := make([]parquet.Row, len(rows)+1)
+	n, err := reader.ReadRows(read)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	if n != len(rows) {
+		t.Fatalf("%d rows, want %d", n, len(rows))
+	}
+	for i := range rows {
+		for c := range columns {
+			var got parquetValue
+			switch value := read[i][leaves[c]]; {
+			case value.IsNull():
+			case columns[c].Type == parquetString:
+				got = value.String()
+			default:
+				got = value.Int64()
+			}
+			if got != rows[i][c] {
+				t.Errorf("row %d column %s: %#v, want %#v", i, columns[c].Name, got, rows[i][c])
+			}
+		}
+	}
+}
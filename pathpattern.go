@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// шаблон пути файлов тех журнала по умолчанию: каталог процесса rphost_1234, файл за час yymmddhh.log
+const defaultPathPattern = "{root}/{process}_{pid}/{yy}{MM}{dd}{hh}.log"
+
+// поля шаблона пути и соответствующие им выражения
+var pathPatternFields = map[string]string{
+	"process": `[^/]+?`,
+	"pid":     `[0-9]+`,
+	"yyyy":    `[0-9]{4}`,
+	"yy":      `[0-9]{2}`,
+	"MM":      `[0-9]{2}`,
+	"dd":      `[0-9]{2}`,
+	"hh":      `[0-9]{2}`,
+	"*":       `[^/]*`,
+}
+
+var rePathPatternField = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// pathPattern шаблон пути файлов тех журнала относительно каталога path
+type pathPattern struct {
+	source string
+	re     *regexp.Regexp
+}
+
+// pathInfo сведения, полученные из пути файла тех журнала
+type pathInfo struct {
+	// Process имя процесса: rphost, rmngr, ragent...
+	Process string
+	// PID идентификатор процесса, пусто - если в шаблоне его нет
+	PID string
+	// FileDate час, за который записан файл, yymmddhh
+	FileDate string
+}
+
+// processNameID идентификатор процесса для поля processNameID: rphost_1234
+func (info pathInfo) processNameID() string {
+	name := strings.ToLower(info.Process)
+	if info.PID == "" {
+		return name
+	}
+	if name == "" {
+		return info.PID
+	}
+	return name + "_" + info.PID
+}
+
+// newPathPattern разбирает и проверяет шаблон пути. Шаблон начинается с {root}, разделитель каталогов - '/'
+// на любой платформе. Обязательны поля даты {yy} или {yyyy}, {MM}, {dd}, {hh}, каждое поле - не более одного раза.
+func newPathPattern(source string) (*pathPattern, error) {
+
+	if source == "" {
+		source = defaultPathPattern
+	}
+	if !strings.HasPrefix(source, "{root}/") {
+		return nil, fmt.Errorf("path pattern %q must start with {root}/", source)
+	}
+	rest := strings.TrimPrefix(source, "{root}/")
+
+	var expr strings.Builder
+	expr.WriteString("^")
+
+	used := make(map[string]bool)
+	last := 0
+	for _, loc := range rePathPatternField.FindAllStringSubmatchIndex(rest, -1) {
+		name := rest[loc[2]:loc[3]]
+		fieldExpr, ok := pathPatternFields[name]
+		if !ok {
+			return nil, fmt.Errorf("path pattern %q: unknown field {%s}", source, name)
+		}
+		if used[name] && name != "*" {
+			return nil, fmt.Errorf("path pattern %q: field {%s} is used more than once", source, name)
+		}
+		used[name] = true
+
+		expr.WriteString(regexp.QuoteMeta(rest[last:loc[0]]))
+		if name == "*" {
+			expr.WriteString(fieldExpr)
+		} else {
+			expr.WriteString("(?P<" + name + ">" + fieldExpr + ")")
+		}
+		last = loc[1]
+	}
+	tail := rest[last:]
+	if strings.ContainsAny(tail, "{}") {
+		return nil, fmt.Errorf("path pattern %q: unbalanced braces", source)
+	}
+	expr.WriteString(regexp.QuoteMeta(tail))
+	expr.WriteString("$")
+
+	if used["yy"] == used["yyyy"] {
+		return nil, fmt.Errorf("path pattern %q: exactly one of {yy} or {yyyy} is required", source)
+	}
+	for _, name := range []string{"MM", "dd", "hh"} {
+		if !used[name] {
+			return nil, fmt.Errorf("path pattern %q: field {%s} is required", source, name)
+		}
+	}
+
+	re, err := regexp.Compile(expr.String())
+	if err != nil {
+		return nil, fmt.Errorf("path pattern %q: %v", source, err)
+	}
+	return &pathPattern{source: source, re: re}, nil
+}
+
+// match сопоставляет путь файла с шаблоном, false - файл не соответствует шаблону или дата в пути некорректна
+func (p *pathPattern) match(root string, path string) (pathInfo, bool) {
+
+	var info pathInfo
+
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return info, false
+	}
+	values := p.re.FindStringSubmatch(filepath.ToSlash(rel))
+	if values == nil {
+		return info, false
+	}
+
+	fields := make(map[string]string)
+	for i, name := range p.re.SubexpNames() {
+		if name != "" {
+			fields[name] = values[i]
+		}
+	}
+
+	year := fields["yy"]
+	if year == "" {
+		year = fields["yyyy"][2:]
+	}
+	info.FileDate = year + fields["MM"] + fields["dd"] + fields["hh"]
+	if _, err := time.Parse("06010215", info.FileDate); err != nil {
+		return info, false
+	}
+	info.Process = fields["process"]
+	info.PID = fields["pid"]
+
+	return info, true
+}
+
+// matchFile сопоставляет с шаблоном файл тех журнала. Сжатый файл сопоставляется по имени без .gz или .zst,
+// файл архива zip - по пути внутри архива от каталога архива (архив с каталогами процессов) или от каталога
+// с именем архива (архив rphost_1234.zip с файлами процесса)
+func (p *pathPattern) matchFile(root string, file files) (pathInfo, bool) {
+
+	if file.Archive == "" {
+		return p.match(root, trimCompressedExt(file.Path))
+	}
+
+	entry := trimCompressedExt(filepath.FromSlash(path.Clean("/" + file.Entry)[1:]))
+	if info, ok := p.match(root, filepath.Join(filepath.Dir(file.Archive), entry)); ok {
+		return info, true
+	}
+	archiveDir := strings.TrimSuffix(file.Archive, filepath.Ext(file.Archive))
+	return p.match(root, filepath.Join(archiveDir, entry))
+}
+
+// trimCompressedExt имя файла без расширения .gz или .zst
+func trimCompressedExt(name string) string {
+	if isCompressedFile(name) {
+		return strings.TrimSuffix(name, filepath.Ext(name))
+	}
+	return name
+}
+
+// файлы, о несоответствии которых шаблону уже сообщалось, чтобы не повторять предупреждение на каждом проходе
+var reportedUnmatchedFiles = make(map[string]bool)
+
+// pruneReportedUnmatchedFiles забывает файлы, которых нет среди файлов текущего прохода: в режиме службы
+// часовые файлы удаляются 1С, и без этого список растет все время работы
+func pruneReportedUnmatchedFiles(arr []files) {
+
+	if len(reportedUnmatchedFiles) == 0 {
+		return
+	}
+	present := make(map[string]bool, len(arr))
+	for _, file := range arr {
+		present[file.Path] = true
+	}
+	for path := range reportedUnmatchedFiles {
+		if !present[path] {
+			delete(reportedUnmatchedFiles, path)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestPathPatternMatch(t *testing.T) {
+
+	tests := []struct {
+		pattern string
+		path    string
+		ok      bool
+		want    pathInfo
+	}{
+		{"", "rphost_1234/24010203.log", true, pathInfo{Process: "rphost", PID: "1234", FileDate: "24010203"}},
+		{"", "rphost_1234/24010203.log.gz", false, pathInfo{}},
+		{"", "rphost_1234/24013203.log", false, pathInfo{}},
+		{"", "rphost/24010203.log", false, pathInfo{}},
+		{"{root}/{process}/{yyyy}{MM}{dd}{hh}.log", "rmngr/2024010203.log", true, pathInfo{Process: "rmngr", FileDate: "24010203"}},
+		{"{root}/{*}/{process}_{pid}/{yy}{MM}{dd}{hh}.log", "srv1/ragent_77/24010203.log", true,
+			pathInfo{Process: "ragent", PID: "77", FileDate: "24010203"}},
+	}
+
+	for _, tt := range tests {
+		p, err := newPathPattern(tt.pattern)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.pattern, err)
+		}
+		info, ok := p.match("logs", filepath.Join("logs", filepath.FromSlash(tt.path)))
+		if ok != tt.ok || ok && info != tt.want {
+			t.Errorf("%s %s: %+v %v, want %+v %v", tt.pattern, tt.path, info, ok, tt.want, tt.ok)
+		}
+	}
+
+	for _, pattern := range []string{
+		"{process}/{yy}{MM}{dd}{hh}.log",
+		"{root}/{yy}{MM}{dd}.log",
+		"{root}/{yy}{yyyy}{MM}{dd}{hh}.log",
+		"{root}/{pid}_{pid}/{yy}{MM}{dd}{hh}.log",
+		"{root}/{host}/{yy}{MM}{dd}{hh}.log",
+		"{root}/{yy}{MM}{dd}{hh}.log}",
+	} {
+		if _, err := newPathPattern(pattern); err == nil {
+			t.Errorf("%s: no error", pattern)
+		}
+	}
+}
+
+func TestPruneReportedUnmatchedFiles(t *testing.T) {
+
+	defer func() { reportedUnmatchedFiles = make(map[string]bool) }()
+
+	reportedUnmatchedFiles = map[string]bool{"logs/a.txt": true, "logs/b.txt": true}
+	pruneReportedUnmatchedFiles([]files{{Path: "logs/b.txt"}, {Path: "logs/rphost_1/24010203.log"}})
+	if len(reportedUnmatchedFiles) != 1 || !reportedUnmatchedFiles["logs/b.txt"] {
+		t.Errorf("reported files %v", reportedUnmatchedFiles)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io"
+	"strconv"
+)
+
+// filePipeline разбор событий файла тех журнала, общий для задания отправки и команды convert:
+// чтение событий, разбор свойств с обработчиками полей, анализ блокировок, связь с вызовами CALL
+// и отбор событий. Событие, прошедшее отбор, передается функции emit.
+type filePipeline struct {
+	config      *conf
+	file        files
+	multiValued map[string]map[string]bool
+	reader      *eventReader
+	clock       *eventClock
+	// correlator события внутри вызова задерживаются до появления их CALL, nil - без связи с вызовами
+	correlator *callCorrelator
+	// trigger смещение события, после чтения которого события передаются emit
+	trigger int64
+	emit    func(item *fileEvent, trigger int64)
+}
+
+// newFilePipeline разбор событий файла, открытого с позиции position
+func newFilePipeline(config *conf, file files, r io.Reader, position int64, multiValued map[string]map[string]bool,
+	emit func(item *fileEvent, trigger int64)) *filePipeline {
+
+	reader := newEventReader(r, position)
+	reader.path = file.Path
+	reader.maxSize = getMaxEventSize(config)
+
+	p := &filePipeline{
+		config:      config,
+		file:        file,
+		multiValued: multiValued,
+		reader:      reader,
+		clock:       newEventClock(file.FileDate, file.Source.location, file.HourState),
+		emit:        emit,
+	}
+	if config.CorrelateCalls {
+		p.correlator = newCallCorrelator(file.Path, config.reCorrelate, getCorrelateWindow(config), getCorrelateMaxPending(config))
+	}
+	return p
+}
+
+// next читает и разбирает очередное событие, передает emit события, готовые к отправке.
+// false - файл прочитан до конца.
+func (p *filePipeline) next() (bool, error) {
+
+	event, err := p.reader.next()
+	if err == io.EOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	item := &fileEvent{raw: event, event: parseEvent(event, p.file, p.clock, p.config, p.multiValued), hour: p.clock.hourState()}
+	p.trigger = event.Start
+
+	if p.config.locks != nil {
+		p.config.locks.observe(p.file, event, item.event)
+	}
+
+	if p.correlator == nil {
+		p.accept(item)
+		return true, nil
+	}
+	for _, ready := range p.correlator.add(item) {
+		p.accept(ready)
+	}
+	return true, nil
+}
+
+// accept применяет к событию правила отбора источника
+func (p *filePipeline) accept(item *fileEvent) {
+
+	if !p.file.Source.acceptEvent(item.event, p.file.Path+":"+strconv.FormatInt(item.raw.Start, 10)) {
+		return
+	}
+	p.emit(item, p.trigger)
+}
+
+// flush передает ожидающие вызова события без связи, когда файл больше не дописывается.
+// trigger - смещение, после чтения которого события считаются переданными.
+func (p *filePipeline) flush(trigger int64) {
+
+	if p.correlator == nil {
+		return
+	}
+	p.trigger = trigger
+	for _, ready := range p.correlator.flush() {
+		p.accept(ready)
+	}
+}
+
+// earliest самое раннее событие, ожидающее вызова, nil - ожидающих нет
+func (p *filePipeline) earliest() *fileEvent {
+	if p.correlator == nil {
+		return nil
+	}
+	return p.correlator.earliest()
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// замена значения по умолчанию для обработчика mask
+const defaultMask = "***"
+
+// processorConf обработчик полей события. Обработчики применяются по порядку к каждому событию при разборе,
+// до вычисления производных полей (sql_normalized, context_first...), анализа блокировок, связи с вызовами
+// и правил отбора.
+// rename - переименовать поле field в target
+// drop - удалить поля fields
+// replace - заменить в значениях полей fields совпадения pattern на replacement ($1 - группа)
+// mask - скрыть значения полей fields целиком или только совпадения pattern, replacement по умолчанию ***
+// copy - скопировать поле field в target
+// add_tags - добавить поля tags со статическими значениями
+type processorConf struct {
+	Type string `yaml:"type"`
+	// Events регулярное выражение имен событий, к которым применяется обработчик, пусто - ко всем
+	Events      string            `yaml:"events"`
+	Field       string            `yaml:"field"`
+	Fields      []string          `yaml:"fields"`
+	Target      string            `yaml:"target"`
+	Pattern     string            `yaml:"pattern"`
+	Replacement string            `yaml:"replacement"`
+	Tags        map[string]string `yaml:"tags"`
+}
+
+// eventProcessor разобранный обработчик полей
+type eventProcessor struct {
+	processorConf
+	reEvents  *regexp.Regexp
+	rePattern *regexp.Regexp
+}
+
+// newEventProcessors проверяет и разбирает обработчики полей
+func newEventProcessors(confs []processorConf) ([]*eventProcessor, error) {
+
+	var processors []*eventProcessor
+	for i, pc := range confs {
+
+		processor := &eventProcessor{processorConf: pc}
+		if pc.Field != "" {
+			processor.Fields = append([]string{pc.Field}, pc.Fields...)
+		}
+
+		switch pc.Type {
+		case "rename", "copy":
+			if pc.Field == "" || pc.Target == "" {
+				return nil, fmt.Errorf("processor %d (%s): field and target are required", i+1, pc.Type)
+			}
+		case "drop":
+			if len(processor.Fields) == 0 {
+				return nil, fmt.Errorf("processor %d (%s): fields are required", i+1, pc.Type)
+			}
+		case "replace":
+			if len(processor.Fields) == 0 || pc.Pattern == "" {
+				return nil, fmt.Errorf("processor %d (%s): fields and pattern are required", i+1, pc.Type)
+			}
+		case "mask":
+			if len(processor.Fields) == 0 {
+				return nil, fmt.Errorf("processor %d (%s): fields are required", i+1, pc.Type)
+			}
+			if processor.Replacement == "" {
+				processor.Replacement = defaultMask
+			}
+		case "add_tags":
+			if len(pc.Tags) == 0 {
+				return nil, fmt.Errorf("processor %d (%s): tags are required", i+1, pc.Type)
+			}
+		default:
+			return nil, fmt.Errorf("processor %d: unknown type %q", i+1, pc.Type)
+		}
+
+		if pc.Events != "" {
+			re, err := regexp.Compile(fmt.Sprintf("(?i)^(%s)$", pc.Events))
+			if err != nil {
+				return nil, fmt.Errorf("processor %d (%s): events: %v", i+1, pc.Type, err)
+			}
+			processor.reEvents = re
+		}
+		if pc.Pattern != "" {
+			re, err := regexp.Compile(pc.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("processor %d (%s): pattern: %v", i+1, pc.Type, err)
+			}
+			processor.rePattern = re
+		}
+
+		processors = append(processors, processor)
+	}
+	return processors, nil
+}
+
+// lookupField возвращает имя поля события: имя как есть (processNameID, SourceFile)
+// или приведенное к имени свойства тех журнала (t:connectID -> t_connectid)
+func lookupField(fields map[string]interface{}, name string) (string, bool) {
+	if _, ok := fields[name]; ok {
+		return name, true
+	}
+	name = getPropertyName(name)
+	_, ok := fields[name]
+	return name, ok
+}
+
+// applyProcessors применяет обработчики к полям события
+func applyProcessors(processors []*eventProcessor, event *techLogEvent) {
+	for _, processor := range processors {
+		if processor.reEvents == nil || processor.reEvents.MatchString(event.Name) {
+			processor.apply(event.Fields)
+		}
+	}
+}
+
+func (p *eventProcessor) apply(fields map[string]interface{}) {
+
+	switch p.Type {
+	case "rename":
+		if name, ok := lookupField(fields, p.Field); ok {
+			value := fields[name]
+			delete(fields, name)
+			fields[p.Target] = value
+		}
+	case "copy":
+		if name, ok := lookupField(fields, p.Field); ok {
+			fields[p.Target] = copyValue(fields[name])
+		}
+	case "drop":
+		for _, field := range p.Fields {
+			if name, ok := lookupField(fields, field); ok {
+				delete(fields, name)
+			}
+		}
+	case "replace", "mask":
+		for _, field := range p.Fields {
+			if name, ok := lookupField(fields, field); ok {
+				fields[name] = mapValue(fields[name], p.transform)
+			}
+		}
+	case "add_tags":
+		for name, value := range p.Tags {
+			fields[name] = value
+		}
+	}
+}
+
+// transform изменяет одно строковое значение для replace и mask
+func (p *eventProcessor) transform(value string) string {
+	if p.rePattern == nil {
+		return p.Replacement
+	}
+	return p.rePattern.ReplaceAllString(value, p.Replacement)
+}
+
+// mapValue применяет преобразование строки к значению поля любого типа. Числовое значение
+// остается числом, если результат преобразования - число, иначе становится строкой. Массив чисел
+// остается числовым, если числами остались все его значения.
+func mapValue(value interface{}, fn func(string) string) interface{} {
+	switch value := value.(type) {
+	case string:
+		return fn(value)
+	case []string:
+		result := make([]string, len(value))
+		for i, v := range value {
+			result[i] = fn(v)
+		}
+		return result
+	case int64:
+		str := fn(strconv.FormatInt(value, 10))
+		if number, err := strconv.ParseInt(str, 10, 64); err == nil {
+			return number
+		}
+		return str
+	case []int64:
+		strs := make([]string, len(value))
+		numbers := make([]int64, len(value))
+		numeric := true
+		for i, v := range value {
+			strs[i] = fn(strconv.FormatInt(v, 10))
+			var err error
+			if numbers[i], err = strconv.ParseInt(strs[i], 10, 64); err != nil {
+				numeric = false
+			}
+		}
+		if numeric {
+			return numbers
+		}
+		return strs
+	}
+	return value
+}
+
+// copyValue копирует значение поля, чтобы изменение копии не затрагивало исходное поле
+func copyValue(value interface{}) interface{} {
+	switch values := value.(type) {
+	case []string:
+		return append([]string(nil), values...)
+	case []int64:
+		return append([]int64(nil), values...)
+	}
+	return value
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestApplyProcessors(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		processors []processorConf
+		want       string
+	}{
+		{"rename", []processorConf{{Type: "rename", Field: "t:connectID", Target: "connect"}},
+			"map[connect:5 duration:100 event_techlog:CALL usr:[Иванов Петров]]"},
+		{"drop", []processorConf{{Type: "drop", Fields: []string{"Usr", "t:connectID"}}},
+			"map[duration:100 event_techlog:CALL]"},
+		{"mask array values", []processorConf{{Type: "mask", Field: "usr", Pattern: "ов$", Replacement: "**"}},
+			"map[duration:100 event_techlog:CALL t_connectid:5 usr:[Иван** Петр**]]"},
+		{"replace number stays number", []processorConf{{Type: "replace", Field: "duration", Pattern: "^1", Replacement: "2"}},
+			"map[duration:200 event_techlog:CALL t_connectid:5 usr:[Иванов Петров]]"},
+		{"copy and add tags", []processorConf{
+			{Type: "copy", Field: "usr", Target: "usr_copy"},
+			{Type: "add_tags", Tags: map[string]string{"env": "prod"}},
+		}, "map[duration:100 env:prod event_techlog:CALL t_connectid:5 usr:[Иванов Петров] usr_copy:[Иванов Петров]]"},
+		{"other events are not processed", []processorConf{{Type: "drop", Events: "EXCP", Field: "usr"}},
+			"map[duration:100 event_techlog:CALL t_connectid:5 usr:[Иванов Петров]]"},
+	}
+
+	for _, tt := range tests {
+		processors, err := newEventProcessors(tt.processors)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		event := &techLogEvent{Name: "CALL", Fields: map[string]interface{}{
+			"duration":      int64(100),
+			"event_techlog": "CALL",
+			"t_connectid":   "5",
+			"usr":           []string{"Иванов", "Петров"},
+		}}
+		applyProcessors(processors, event)
+		if got := fmt.Sprint(event.Fields); got != tt.want {
+			t.Errorf("%s:\n got %s\nwant %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestProcessorsBeforeDerivedFields(t *testing.T) {
+
+	config := &conf{
+		Path:             "logs",
+		NormalizeQueries: true,
+		SplitContext:     true,
+		Processors: []processorConf{
+			{Type: "mask", Field: "Context", Pattern: "Иванов"},
+			{Type: "mask", Field: "Usr"},
+			{Type: "drop", Field: "Sql"},
+		},
+	}
+	parse := func(start int64, body string) (*rawEvent, *techLogEvent) {
+		raw := &rawEvent{Header: "04:05.000001", Body: body, Start: start, End: start + 100}
+		return raw, parseTestEvent(t, config, raw, nil)
+	}
+
+	_, query := parse(0, "10,DBMSSQL,1,Usr=Иванов,Sql='SELECT 1 FROM T WHERE Name = ''Иванов''',"+
+		"Context='Справочник.Иванов.Форма : 1 : Записать();'")
+	if query.Fields["context_first"] != "Справочник.***.Форма : 1 : Записать();" {
+		t.Errorf("context_first %q", query.Fields["context_first"])
+	}
+	if query.Fields["usr"] != "***" {
+		t.Errorf("usr %q", query.Fields["usr"])
+	}
+	for _, name := range []string{"sql", "sql_normalized", "sql_hash"} {
+		if _, ok := query.Fields[name]; ok {
+			t.Errorf("dropped Sql leaks into %s", name)
+		}
+	}
+
+	// анализ блокировок получает значения после обработчиков
+	config.locks = newLockAnalyzer()
+	raw, wait := parse(100, "1000,TLOCK,1,t:connectID=8,Usr=Иванов,Locks='InfoRg1.DIMS Exclusive Fld2=1',"+
+		"WaitConnections=7,Context='Документ.Иванов : 2'")
+	config.locks.observe(files{Path: "a.log"}, raw, wait)
+	docs := config.locks.flush()
+	if len(docs) != 1 {
+		t.Fatalf("%d LOCKCHAIN documents", len(docs))
+	}
+	if usr := docs[0].Event.Fields["victim_usr"]; usr != "***" {
+		t.Errorf("victim_usr %q", usr)
+	}
+	if context := docs[0].Event.Fields["victim_context"]; context != "'Документ.*** : 2'" {
+		t.Errorf("victim_context %q", context)
+	}
+}
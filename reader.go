@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"regexp"
+	"strconv"
+
+	logr "github.com/sirupsen/logrus"
+)
+
+// размер буфера чтения файла тех журнала
+const readerBufferSize = 64 * 1024
+
+// маркер порядка байт UTF-8, с которого 1С начинает файлы тех журнала
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// строка, начинающая новое событие: mm:ss.uuuuuu-
+var reEventHeader = regexp.MustCompile(`^[0-9][0-9]:[0-9][0-9]\.[0-9]+-`)
+
+// rawEvent событие тех журнала в исходном виде
+type rawEvent struct {
+	// Header время события внутри часа, mm:ss.uuuuuu
+	Header string
+	// Body текст события после заголовка: duration,EVENT,level,Key=Value,...
+	Body string
+	// Start и End смещения события в файле
+	Start int64
+	End   int64
+}
+
+// documentID идентификатор документа события: файл, смещение и текст события. При повторном чтении
+// файла (позиция удержана или не сохранилась) событие получает тот же идентификатор и не дублируется.
+func (e *rawEvent) documentID(path string) string {
+	hash := md5.New()
+	hash.Write([]byte(path + ":" + strconv.FormatInt(e.Start, 10) + "\n"))
+	hash.Write([]byte(e.Header))
+	hash.Write([]byte(e.Body))
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// eventReader последовательно читает события тех журнала из потока.
+// В памяти удерживается только текущее событие и одна строка упреждающего чтения,
+// поэтому потребление памяти не зависит от размера файла.
+//
+// Событие считается завершенным, если оно заканчивается переводом строки вне значения в кавычках.
+// Последнее событие файла, которое 1С еще дописывает, не возвращается: committed указывает
+// на конец последнего завершенного события, с этой позиции файл дочитывается в следующий раз.
+//
+// Событие больше maxSize (например, с незакрытой кавычкой) не накапливается в памяти: оно заканчивается
+// на следующей строке с заголовком события независимо от кавычек и пропускается с ошибкой в логе.
+type eventReader struct {
+	reader *bufio.Reader
+	// path файл для сообщений о пропущенных событиях
+	path string
+	// maxSize максимальный размер события в байтах
+	maxSize int64
+	// position смещение в файле после последней прочитанной части строки
+	position int64
+	// committed смещение в файле после последнего завершенного события
+	committed int64
+	// lineStart следующая часть начинает строку
+	lineStart bool
+	// lookahead заголовочная строка следующего события и ее смещение
+	lookahead      []byte
+	lookaheadStart int64
+	eof            bool
+}
+
+// размер события по умолчанию, больше которого событие пропускается
+const defaultMaxEventSize = 128 * 1024 * 1024
+
+// newEventReader создает читатель событий, position - смещение, с которого начинается поток
+func newEventReader(r io.Reader, position int64) *eventReader {
+	return &eventReader{
+		reader:    bufio.NewReaderSize(r, readerBufferSize),
+		maxSize:   defaultMaxEventSize,
+		position:  position,
+		committed: position,
+		lineStart: true,
+	}
+}
+
+// getMaxEventSize максимальный размер события из настроек
+func getMaxEventSize(c *conf) int64 {
+	if c.MaxEventSize <= 0 {
+		return defaultMaxEventSize
+	}
+	return c.MaxEventSize
+}
+
+// readPart читает строку до перевода строки включительно, но не больше буфера чтения: длинная строка
+// возвращается частями. lineStart - часть начинает строку. Часть действительна до следующего чтения.
+func (er *eventReader) readPart() (part []byte, lineStart bool, err error) {
+
+	lineStart = er.lineStart
+	part, err = er.reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		err = nil
+	}
+	if er.position == 0 && bytes.HasPrefix(part, utf8BOM) {
+		part = part[len(utf8BOM):]
+		er.position += int64(len(utf8BOM))
+	}
+	er.position += int64(len(part))
+	er.lineStart = len(part) > 0 && part[len(part)-1] == '\n'
+	if err == io.EOF {
+		er.eof = true
+	}
+	return part, lineStart, err
+}
+
+// next возвращает очередное завершенное событие, io.EOF - завершенных событий больше нет.
+// Строки до первого заголовка (хвост события, прочитанного ранее) пропускаются.
+func (er *eventReader) next() (*rawEvent, error) {
+
+	for {
+		event, err := er.readEvent()
+		if err != nil || event != nil {
+			return event, err
+		}
+	}
+}
+
+// readEvent читает очередное событие, nil без ошибки - событие больше maxSize пропущено
+func (er *eventReader) readEvent() (*rawEvent, error) {
+
+	// ищем заголовок события
+	for er.lookahead == nil {
+		if er.eof {
+			return nil, io.EOF
+		}
+		start := er.position
+		part, lineStart, err := er.readPart()
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if lineStart && reEventHeader.Match(part) {
+			er.lookahead = append([]byte(nil), part...)
+			er.lookaheadStart = start
+			break
+		}
+		// строка без заголовка дописана полностью - пропускаем ее
+		if er.lineStart {
+			er.committed = er.position
+		}
+	}
+
+	event := &rawEvent{Start: er.lookaheadStart}
+	var body bytes.Buffer
+	var quotes lexState
+	var size int64
+	oversized := false
+
+	part := er.lookahead
+	lineStart := true
+	er.lookahead = nil
+
+	// дочитываем строки события до следующего заголовка вне кавычек
+	for {
+		size += int64(len(part))
+		if !oversized {
+			body.Write(part)
+			quotes.scan(part)
+			if size > er.maxSize {
+				// событие не накапливается дальше, его граница - следующий заголовок
+				oversized = true
+				body = bytes.Buffer{}
+			}
+		}
+
+		// строка без перевода строки в конце файла - 1С еще дописывает событие
+		if er.eof {
+			return nil, io.EOF
+		}
+
+		start := er.position
+		var err error
+		part, lineStart, err = er.readPart()
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if len(part) == 0 && er.eof {
+			// событие дописано полностью, только если перевод строки в конце файла вне кавычек
+			if !oversized && !quotes.closed() {
+				return nil, io.EOF
+			}
+			break
+		}
+		if lineStart && (oversized || quotes.closed()) && reEventHeader.Match(part) {
+			er.lookahead = append([]byte(nil), part...)
+			er.lookaheadStart = start
+			break
+		}
+	}
+
+	if er.lookahead != nil {
+		event.End = er.lookaheadStart
+	} else {
+		event.End = er.position
+	}
+	er.committed = event.End
+
+	if oversized {
+		logr.WithFields(logr.Fields{
+			"object": "Data",
+			"title":  "Event is too large, skipped",
+		}).Errorf("%s: event at %d-%d is larger than %d bytes", er.path, event.Start, event.End, er.maxSize)
+		return nil, nil
+	}
+
+	text := bytes.TrimRight(body.Bytes(), "\r\n")
+	headerLen := len(reEventHeader.Find(text))
+	event.Header = string(text[:headerLen-1])
+	event.Body = string(text[headerLen:])
+
+	return event, nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestEventReader(t *testing.T) {
+
+	tests := []struct {
+		name string
+		data string
+		// events заголовки прочитанных событий, committed - позиция после последнего завершенного события
+		events    []string
+		bodies    []string
+		committed int64
+	}{
+		{
+			name:      "complete events",
+			data:      "00:01.000001-1,CALL,1\n00:02.000002-2,SDBL,1\n",
+			events:    []string{"00:01.000001", "00:02.000002"},
+			bodies:    []string{"1,CALL,1", "2,SDBL,1"},
+			committed: 44,
+		},
+		{
+			name:      "last event is being written",
+			data:      "00:01.000001-1,CALL,1\n00:02.000002-2,SDBL,1",
+			events:    []string{"00:01.000001"},
+			bodies:    []string{"1,CALL,1"},
+			committed: 22,
+		},
+		{
+			name:      "multi-line value in quotes",
+			data:      "00:01.000001-1,DBMSSQL,1,Sql='SELECT\n00:02.000002-2\nFROM T',Rows=1\n00:03.000003-3,CALL,1\n",
+			events:    []string{"00:01.000001", "00:03.000003"},
+			bodies:    []string{"1,DBMSSQL,1,Sql='SELECT\n00:02.000002-2\nFROM T',Rows=1", "3,CALL,1"},
+			committed: 89,
+		},
+		{
+			name:      "quote is not closed yet",
+			data:      "00:01.000001-1,CALL,1\n00:02.000002-2,DBMSSQL,1,Sql='SELECT\n",
+			events:    []string{"00:01.000001"},
+			bodies:    []string{"1,CALL,1"},
+			committed: 22,
+		},
+		{
+			name:      "escaped quote inside value",
+			data:      "00:01.000001-1,EXCP,1,Descr='it''s\nhere'\n00:02.000002-2,CALL,1\n",
+			events:    []string{"00:01.000001", "00:02.000002"},
+			bodies:    []string{"1,EXCP,1,Descr='it''s\nhere'", "2,CALL,1"},
+			committed: 63,
+		},
+		{
+			name:      "byte order mark and CRLF",
+			data:      "\xEF\xBB\xBF00:01.000001-1,CALL,1\r\n00:02.0001-2,SDBL,1\r\n",
+			events:    []string{"00:01.000001", "00:02.0001"},
+			bodies:    []string{"1,CALL,1", "2,SDBL,1"},
+			committed: 47,
+		},
+		{
+			name:      "tail of event read earlier",
+			data:      "FROM T',Rows=1\n00:03.000003-3,CALL,1\n",
+			events:    []string{"00:03.000003"},
+			bodies:    []string{"3,CALL,1"},
+			committed: 37,
+		},
+	}
+
+	for _, tt := range tests {
+		reader := newEventReader(strings.NewReader(tt.data), 0)
+		var headers, bodies []string
+		var end int64
+		for {
+			event, err := reader.next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			if event.Start != end && len(headers) > 0 {
+				t.Errorf("%s: event %s starts at %d, previous ends at %d", tt.name, event.Header, event.Start, end)
+			}
+			end = event.End
+			headers = append(headers, event.Header)
+			bodies = append(bodies, event.Body)
+		}
+		if strings.Join(headers, "|") != strings.Join(tt.events, "|") {
+			t.Errorf("%s: events %q, want %q", tt.name, headers, tt.events)
+		}
+		if strings.Join(bodies, "|") != strings.Join(tt.bodies, "|") {
+			t.Errorf("%s: bodies %q, want %q", tt.name, bodies, tt.bodies)
+		}
+		if reader.committed != tt.committed {
+			t.Errorf("%s: committed %d, want %d", tt.name, reader.committed, tt.committed)
+		}
+	}
+}
+
+func TestEventReaderResume(t *testing.T) {
+
+	// файл дописывается между проходами: второй проход читает с сохраненной позиции
+	first := "00:01.000001-1,CALL,1\n00:02.000002-2,DBMSSQL,1,Sql='SELECT"
+	full := first + "\nFROM T'\n00:03.000003-3,CALL,1\n"
+
+	reader := newEventReader(strings.NewReader(first), 0)
+	for {
+		if _, err := reader.next(); err != nil {
+			break
+		}
+	}
+	position := reader.committed
+
+	reader = newEventReader(strings.NewReader(full[position:]), position)
+	event, err := reader.next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Start != position || event.Body != "2,DBMSSQL,1,Sql='SELECT\nFROM T'" {
+		t.Errorf("resumed event at %d: %q", event.Start, event.Body)
+	}
+	if _, err := reader.next(); err != nil || reader.committed != int64(len(full)) {
+		t.Errorf("committed %d of %d: %v", reader.committed, len(full), err)
+	}
+}
+
+func TestEventReaderMaxSize(t *testing.T) {
+
+	long := strings.Repeat("x", 3*readerBufferSize)
+	tests := []struct {
+		name    string
+		data    string
+		maxSize int64
+		bodies  []string
+	}{
+		{
+			name:    "unclosed quote past max size ends at next header",
+			data:    "00:01.000001-1,EXCP,1,Descr='broken\n00:02.000002-2,CALL,1\n00:03.000003-3,CALL,1\n",
+			maxSize: 40,
+			bodies:  []string{"3,CALL,1"},
+		},
+		{
+			name:    "unclosed quote within max size keeps following lines",
+			data:    "00:01.000001-1,EXCP,1,Descr='broken\n00:02.000002-2,CALL,1\n",
+			maxSize: 1000,
+			bodies:  nil,
+		},
+		{
+			name:    "quote inside unquoted value",
+			data:    "00:01.000001-1,EXCP,1,Descr=a='b\n00:02.000002-2,CALL,1\n",
+			maxSize: 1000,
+			bodies:  []string{"1,EXCP,1,Descr=a='b", "2,CALL,1"},
+		},
+		{
+			name:    "line longer than read buffer",
+			data:    "00:01.000001-1,EXCP,1,Descr=" + long + "\n00:02.000002-2,CALL,1\n",
+			maxSize: defaultMaxEventSize,
+			bodies:  []string{"1,EXCP,1,Descr=" + long, "2,CALL,1"},
+		},
+		{
+			name:    "line longer than max size",
+			data:    "00:01.000001-1,EXCP,1,Descr=" + long + "\n00:02.000002-2,CALL,1\n",
+			maxSize: readerBufferSize,
+			bodies:  []string{"2,CALL,1"},
+		},
+	}
+
+	for _, tt := range tests {
+		reader := newEventReader(strings.NewReader(tt.data), 0)
+		reader.maxSize = tt.maxSize
+		var bodies []string
+		for {
+			event, err := reader.next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			bodies = append(bodies, event.Body)
+		}
+		if strings.Join(bodies, "|") != strings.Join(tt.bodies, "|") {
+			t.Errorf("%s: bodies %.80q, want %.80q", tt.name, bodies, tt.bodies)
+		}
+		if len(tt.bodies) > 0 && reader.committed != int64(len(tt.data)) {
+			t.Errorf("%s: committed %d of %d", tt.name, reader.committed, len(tt.data))
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// sourceConf каталог тех журнала со своими настройками, например отдельные logcfg для блокировок и для запросов.
+// Незаполненные настройки берутся из одноименных параметров верхнего уровня settings.yaml.
+type sourceConf struct {
+	// Name имя источника для логов программы, по умолчанию - путь
+	Name                 string `yaml:"name"`
+	Path                 string `yaml:"path"`
+	PathPattern          string `yaml:"path_pattern"`
+	TimeZone             string `yaml:"time_zone"`
+	ElasticIndx          string `yaml:"elastic_indx"`
+	TechLogDetailsEvents string `yaml:"tech_log_details_events"`
+	// Events регулярное выражение имен событий, которые нужно отправлять, пусто - все события
+	Events string `yaml:"events"`
+	// Tags поля, которые добавляются к каждому событию источника: кластер, среда, имя сервера
+	Tags map[string]string `yaml:"tags"`
+	// Filters правила отбора событий источника, проверяются раньше общих правил filters
+	Filters []filterConf `yaml:"filters"`
+	// Processors обработчики полей событий источника, применяются раньше общих обработчиков processors
+	Processors []processorConf `yaml:"processors"`
+}
+
+// logSource источник тех журнала с проверенными и разобранными настройками
+type logSource struct {
+	sourceConf
+
+	location    *time.Location
+	pathPattern *pathPattern
+	reDetails   *regexp.Regexp
+	reEvents    *regexp.Regexp
+	filters     []*eventFilter
+	processors  []*eventProcessor
+}
+
+// getSourceConfs возвращает источники из секции sources, без нее - единственный источник
+// из параметров верхнего уровня path, path_pattern, time_zone, elastic_indx, tech_log_details_events
+func (c *conf) getSourceConfs() []sourceConf {
+
+	if len(c.Sources) == 0 {
+		return []sourceConf{{Path: c.Path}}
+	}
+	return c.Sources
+}
+
+// initSources проверяет и разбирает настройки источников
+func (c *conf) initSources() error {
+
+	c.sources = nil
+	for i, sc := range c.getSourceConfs() {
+
+		if sc.Path == "" {
+			return fmt.Errorf("source %d: path is required", i+1)
+		}
+		if sc.Name == "" {
+			sc.Name = sc.Path
+		}
+		if sc.PathPattern == "" {
+			sc.PathPattern = c.PathPattern
+		}
+		if sc.TimeZone == "" {
+			sc.TimeZone = c.TimeZone
+		}
+		if sc.ElasticIndx == "" {
+			sc.ElasticIndx = c.ElasticIndx
+		}
+		if sc.TechLogDetailsEvents == "" {
+			sc.TechLogDetailsEvents = c.TechLogDetailsEvents
+		}
+
+		source := &logSource{sourceConf: sc}
+		var err error
+
+		if source.location, err = loadLocation(sc.TimeZone); err != nil {
+			return fmt.Errorf("source %s: time_zone: %v", sc.Name, err)
+		}
+		if source.pathPattern, err = newPathPattern(sc.PathPattern); err != nil {
+			return fmt.Errorf("source %s: %v", sc.Name, err)
+		}
+		if source.reDetails, err = regexp.Compile(fmt.Sprintf("(?i)^(%s)$", sc.TechLogDetailsEvents)); err != nil {
+			return fmt.Errorf("source %s: tech_log_details_events: %v", sc.Name, err)
+		}
+		if sc.Events != "" {
+			if source.reEvents, err = regexp.Compile(fmt.Sprintf("(?i)^(%s)$", sc.Events)); err != nil {
+				return fmt.Errorf("source %s: events: %v", sc.Name, err)
+			}
+		}
+
+		if source.filters, err = newEventFilters(append(append([]filterConf{}, sc.Filters...), c.Filters...)); err != nil {
+			return fmt.Errorf("source %s: %v", sc.Name, err)
+		}
+
+		if source.processors, err = newEventProcessors(append(append([]processorConf{}, sc.Processors...), c.Processors...)); err != nil {
+			return fmt.Errorf("source %s: %v", sc.Name, err)
+		}
+
+		// файл каталога, входящего в два источника, читался бы дважды с одной позицией
+		for _, other := range c.sources {
+			if pathContains(other.Path, sc.Path) || pathContains(sc.Path, other.Path) {
+				return fmt.Errorf("source %s: path %s overlaps source %s (%s)", sc.Name, sc.Path, other.Name, other.Path)
+			}
+		}
+
+		c.sources = append(c.sources, source)
+	}
+	return nil
+}
+
+// pathContains каталог path совпадает с каталогом dir или вложен в него
+func pathContains(dir string, path string) bool {
+
+	dir, errDir := filepath.Abs(dir)
+	path, errPath := filepath.Abs(path)
+	if errDir != nil || errPath != nil {
+		return false
+	}
+	if dir == path {
+		return true
+	}
+	return strings.HasPrefix(path, strings.TrimSuffix(dir, string(filepath.Separator))+string(filepath.Separator))
+}
+
+// getFileSource источник, в каталоге которого лежит файл тех журнала, если такого нет - первый источник
+func (c *conf) getFileSource(path string) *logSource {
+
+	var found *logSource
+	for _, source := range c.sources {
+		dir := filepath.Clean(source.Path) + string(filepath.Separator)
+		if strings.HasPrefix(path, dir) && (found == nil || len(source.Path) > len(found.Path)) {
+			found = source
+		}
+	}
+	if found == nil && len(c.sources) > 0 {
+		found = c.sources[0]
+	}
+	if found == nil {
+		found = &logSource{sourceConf: sourceConf{ElasticIndx: c.ElasticIndx}}
+	}
+	return found
+}
+
+// acceptEvent проверяет, нужно ли отправлять событие из этого источника: отбор по имени events,
+// затем правила отбора источника и общие правила. key - ключ события для выборки.
+func (s *logSource) acceptEvent(event *techLogEvent, key string) bool {
+	if s.reEvents != nil && !s.reEvents.MatchString(event.Name) {
+		return false
+	}
+	return acceptEvent(s.filters, event, key)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMultipleSources(t *testing.T) {
+
+	config := &conf{
+		ElasticIndx: "tech_journal_{event}",
+		TimeZone:    "UTC",
+		Sources: []sourceConf{
+			{Name: "locks", Path: "logs/locks", TimeZone: "Europe/Moscow", Events: "TLOCK",
+				Tags: map[string]string{"env": "prod"}},
+			{Path: "logs/sql", ElasticIndx: "sql_{event}"},
+		},
+	}
+	if err := config.initSources(); err != nil {
+		t.Fatal(err)
+	}
+	locks, sql := config.sources[0], config.sources[1]
+	if sql.Name != "logs/sql" || sql.location != time.UTC || locks.ElasticIndx != "tech_journal_{event}" {
+		t.Errorf("defaults: %+v, %+v", locks.sourceConf, sql.sourceConf)
+	}
+
+	// файл относится к источнику своего каталога, файл вне каталогов - к первому источнику
+	for path, want := range map[string]*logSource{
+		filepath.Join("logs", "sql", "rphost_1", "24010203.log"):   sql,
+		filepath.Join("logs", "locks", "rphost_1", "24010203.log"): locks,
+		filepath.Join("other", "rphost_1", "24010203.log"):         locks,
+	} {
+		if got := config.getFileSource(path); got != want {
+			t.Errorf("%s: source %s, want %s", path, got.Name, want.Name)
+		}
+	}
+
+	// время, теги и отбор событий первого источника - по его настройкам
+	event := parseTestEvent(t, config, &rawEvent{Header: "04:05.000001", Body: "10,TLOCK,1,Usr=Иванов"}, nil)
+	if got := event.Time.UTC().Format(eventDateFormat); got != "2024-01-02T00:04:05.000001Z" {
+		t.Errorf("time %s", got)
+	}
+	if event.Fields["env"] != "prod" {
+		t.Errorf("tags %v", event.Fields)
+	}
+	if !locks.acceptEvent(event, "") || locks.acceptEvent(&techLogEvent{Name: "CALL"}, "") || !sql.acceptEvent(&techLogEvent{Name: "CALL"}, "") {
+		t.Errorf("events of a source are not selected by its events setting")
+	}
+}
+
+func TestOverlappingSources(t *testing.T) {
+
+	tests := []struct {
+		paths []string
+		fail  bool
+	}{
+		{paths: []string{"logs/a", "logs/b"}},
+		{paths: []string{"logs/a", "logs/ab"}},
+		{paths: []string{"logs/a", "logs/a"}, fail: true},
+		{paths: []string{"logs/a", "logs/a/"}, fail: true},
+		{paths: []string{"logs", "logs/a"}, fail: true},
+		{paths: []string{"logs/a/rphost_1", "logs/a"}, fail: true},
+		{paths: []string{"logs/a", "./logs/../logs/a/x"}, fail: true},
+	}
+
+	for _, tt := range tests {
+		config := &conf{}
+		for _, path := range tt.paths {
+			config.Sources = append(config.Sources, sourceConf{Path: path})
+		}
+		err := config.initSources()
+		if tt.fail != (err != nil) {
+			t.Errorf("%s: error %v", strings.Join(tt.paths, ", "), err)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"regexp"
+	"strings"
+)
+
+// диалекты текстов запросов для нормализации
+const (
+	// dialectSQL запрос к СУБД (DBMSSQL, DBPOSTGRS, DBORACLE, DB2): строки в '...', параметры @P1, $1, ?
+	dialectSQL = iota
+	// dialectSDBL запрос на языке запросов 1С (SDBL): строки в "...", параметры &Имя
+	dialectSDBL
+)
+
+// поля с текстами запросов и их диалекты
+var queryFields = map[string]int{
+	"sql":  dialectSQL,
+	"sdbl": dialectSDBL,
+}
+
+// значения параметров, которые 1С дописывает после текста запроса MS SQL: p_0: 0x81A3
+var reQueryParams = regexp.MustCompile(`(?m)^\s*p_[0-9]+: `)
+
+// списки IN из одних литералов и параметров после замены: IN (?, ?, ?), IN (@P, @P) -> IN (?)
+var reInList = regexp.MustCompile(`(?i)\bIN ?\((?:\?|@P|\$)(?: ?, ?(?:\?|@P|\$))*\)`)
+
+// normalizeQuery приводит текст запроса к форме, общей для всех его выполнений: литералы и параметры
+// заменяются на ?, списки IN из литералов сворачиваются, постфиксы временных таблиц (#tt12, pg_temp.tt12)
+// отбрасываются, пробельные символы сжимаются до одного пробела.
+func normalizeQuery(text string, dialect int) string {
+
+	if dialect == dialectSQL {
+		if loc := reQueryParams.FindStringIndex(text); loc != nil {
+			text = text[:loc[0]]
+		}
+	}
+
+	var sb strings.Builder
+	sb.Grow(len(text))
+	space := false
+
+	write := func(s string) {
+		if space && sb.Len() > 0 {
+			sb.WriteByte(' ')
+		}
+		space = false
+		sb.WriteString(s)
+	}
+
+	for i := 0; i < len(text); {
+		c := text[i]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			space = true
+			i++
+
+		// строковый литерал, кавычка внутри экранируется удвоением
+		case c == '\'' || (c == '"' && dialect == dialectSDBL):
+			i = skipQuoted(text, i)
+			write("?")
+
+		// строка Unicode N'...'
+		case (c == 'N' || c == 'n') && i+1 < len(text) && text[i+1] == '\'' && !isIdentByte(prevByte(text, i)):
+			i = skipQuoted(text, i+1)
+			write("?")
+
+		// параметры @P1, $1 - номер параметра не важен
+		case (c == '@' || c == '$') && i+1 < len(text) && isDigit(text[i+1]):
+			j := i + 1
+			for j < len(text) && isDigit(text[j]) {
+				j++
+			}
+			write(text[i : i+1])
+			i = j
+		case c == '@' && i+2 < len(text) && (text[i+1] == 'P' || text[i+1] == 'p') && isDigit(text[i+2]):
+			j := i + 2
+			for j < len(text) && isDigit(text[j]) {
+				j++
+			}
+			write("@P")
+			i = j
+
+		// числа и двоичные литералы 0x..., но не цифры в составе имен (_Fld123, T1)
+		case isDigit(c) && !isIdentByte(prevByte(text, i)):
+			j := i
+			if c == '0' && i+1 < len(text) && (text[i+1] == 'x' || text[i+1] == 'X') {
+				j += 2
+				for j < len(text) && isHexDigit(text[j]) {
+					j++
+				}
+			} else {
+				for j < len(text) && (isDigit(text[j]) || text[j] == '.') {
+					j++
+				}
+			}
+			write("?")
+			i = j
+
+		// имена, временные таблицы #tt1, параметры SDBL &Имя
+		case isIdentByte(c) || c == '#' || c == '&':
+			j := i + 1
+			for j < len(text) && isIdentByte(text[j]) {
+				j++
+			}
+			write(normalizeTempTable(text[i:j]))
+			i = j
+		default:
+			write(text[i : i+1])
+			i++
+		}
+	}
+
+	return reInList.ReplaceAllString(sb.String(), "IN (?)")
+}
+
+// normalizeTempTable отбрасывает номер временной таблицы: #tt12 -> #tt, tt12 (PostgreSQL) -> tt
+func normalizeTempTable(name string) string {
+	lower := strings.ToLower(name)
+	prefix := ""
+	switch {
+	case strings.HasPrefix(lower, "#tt"):
+		prefix = name[:3]
+	case strings.HasPrefix(lower, "tt"):
+		prefix = name[:2]
+	default:
+		return name
+	}
+	rest := name[len(prefix):]
+	if rest == "" {
+		return name
+	}
+	for i := 0; i < len(rest); i++ {
+		if !isDigit(rest[i]) {
+			return name
+		}
+	}
+	return prefix
+}
+
+// skipQuoted возвращает позицию после строкового литерала, начинающегося кавычкой в позиции i
+func skipQuoted(text string, i int) int {
+	quote := text[i]
+	i++
+	for i < len(text) {
+		if text[i] == quote {
+			if i+1 < len(text) && text[i+1] == quote {
+				i += 2
+				continue
+			}
+			return i + 1
+		}
+		i++
+	}
+	return i
+}
+
+func prevByte(text string, i int) byte {
+	if i == 0 {
+		return 0
+	}
+	return text[i-1]
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+// isIdentByte символ имени: латиница, цифры, '_', а также байты UTF-8 (имена на кириллице в SDBL)
+func isIdentByte(c byte) bool {
+	return c == '_' || isDigit(c) || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
+
+// getQueryHash возвращает отпечаток нормализованного запроса для группировки
+func getQueryHash(normalized string) string {
+	hash := md5.Sum([]byte(normalized))
+	return hex.EncodeToString(hash[:])
+}
+
+// addNormalizedQueries добавляет к событию нормализованные тексты запросов и их отпечатки:
+// sql_normalized, sql_hash, sdbl_normalized, sdbl_hash
+func addNormalizedQueries(fields map[string]interface{}) {
+	for name, dialect := range queryFields {
+		values := unquoteValues(fields[name])
+		if len(values) == 0 || values[0] == "" {
+			continue
+		}
+		normalized := normalizeQuery(values[0], dialect)
+		fields[name+"_normalized"] = normalized
+		fields[name+"_hash"] = getQueryHash(normalized)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+)
+
+func TestNormalizeQuery(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		text    string
+		dialect int
+		want    string
+	}{
+		{
+			name: "literals and parameters",
+			text: "SELECT T1._Fld123 FROM _InfoRg45 T1 WHERE T1._Fld124 = @P1 AND T1._Fld125 = N'abc''d' AND T1._Fld126 > 10.5",
+			want: "SELECT T1._Fld123 FROM _InfoRg45 T1 WHERE T1._Fld124 = @P AND T1._Fld125 = ? AND T1._Fld126 > ?",
+		},
+		{
+			name: "postgres parameters and temp table",
+			text: "INSERT INTO pg_temp.tt12 (_Q_000_F_000) SELECT $1 FROM _Reference8 WHERE _IDRRef = '\\\\x81a3'::bytea",
+			want: "INSERT INTO pg_temp.tt (_Q_000_F_000) SELECT $ FROM _Reference8 WHERE _IDRRef = ?::bytea",
+		},
+		{
+			name: "in list and binary literal",
+			text: "DELETE FROM #tt5 WHERE _Fld1 IN (1, 2, 0x81A3, @P4)",
+			want: "DELETE FROM #tt WHERE _Fld1 IN (?)",
+		},
+		{
+			name: "parameter values after ms sql text",
+			text: "SELECT 1 FROM T WHERE A = @P1\np_0: 0x81A3\np_1: 12",
+			want: "SELECT ? FROM T WHERE A = @P",
+		},
+		{
+			name: "whitespace",
+			text: "SELECT\n\t A\r\n  FROM   T",
+			want: "SELECT A FROM T",
+		},
+		{
+			name:    "sdbl strings and parameters",
+			text:    "ВЫБРАТЬ Т.Ссылка ИЗ Справочник.Товары КАК Т ГДЕ Т.Код = \"0001\" И Т.Вес > 5 И Т.Владелец = &Владелец",
+			dialect: dialectSDBL,
+			want:    "ВЫБРАТЬ Т.Ссылка ИЗ Справочник.Товары КАК Т ГДЕ Т.Код = ? И Т.Вес > ? И Т.Владелец = &Владелец",
+		},
+	}
+
+	for _, tt := range tests {
+		if got := normalizeQuery(tt.text, tt.dialect); got != tt.want {
+			t.Errorf("%s:\n got %q\nwant %q", tt.name, got, tt.want)
+		}
+	}
+
+	// запросы одной формы получают один отпечаток
+	first := normalizeQuery("SELECT A FROM #tt1 WHERE B IN (1,2,3)", dialectSQL)
+	second := normalizeQuery("SELECT A  FROM #tt27 WHERE B IN (7)", dialectSQL)
+	if getQueryHash(first) != getQueryHash(second) {
+		t.Errorf("%q and %q have different hashes", first, second)
+	}
+}
+
+// TestDBPostgrsMapTypes разбирает событие DBPOSTGRS и сверяет поля документа с картой maps/dbpostgrs.map:
+// каждое поле объявлено в карте, а значения числовых полей карты разобраны целыми числами
+func TestDBPostgrsMapTypes(t *testing.T) {
+
+	data, err := ioutil.ReadFile("maps/dbpostgrs.map")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m struct {
+		Mappings struct {
+			Properties map[string]struct {
+				Type string `json:"type"`
+			} `json:"properties"`
+		} `json:"mappings"`
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &conf{Path: "logs", NormalizeQueries: true, SplitContext: true, TechLogDetailsEvents: "sql|context"}
+	raw := &rawEvent{
+		Header: "04:05.000001",
+		Body: "15,DBPOSTGRS,4,process=rphost,p:processName=base,OSThread=7,t:clientID=3,t:applicationName=1CV8C," +
+			"t:computerName=srv,t:connectID=9,SessionID=2,Usr=Иванов,AppID=1CV8C,DBMS=DBPOSTGRS,DataBase=srv\\base," +
+			"Trans=1,dbpid=4242,Sql='SELECT T1._Fld1 FROM _InfoRg2 T1 WHERE T1._Fld3 = $1',Rows=2,RowsAffected=0," +
+			"Context='Форма.Вызов : ОбщийМодуль.Модуль.Модуль : 10 : Запрос.Выполнить();'",
+	}
+	event := parseTestEvent(t, config, raw, nil)
+	doc := event.document()
+
+	for name, value := range doc {
+		mapping, ok := m.Mappings.Properties[name]
+		if !ok {
+			t.Errorf("field %s is not declared in dbpostgrs.map", name)
+			continue
+		}
+		switch mapping.Type {
+		case "long", "integer":
+			if _, ok := value.(int64); !ok {
+				t.Errorf("field %s of type %s: %T %v", name, mapping.Type, value, value)
+			}
+		case "text", "keyword", "date":
+			switch value.(type) {
+			case string, []string:
+			default:
+				t.Errorf("field %s of type %s: %T %v", name, mapping.Type, value, value)
+			}
+		}
+	}
+
+	for _, name := range []string{"@timestamp", "duration", "rows", "sql_normalized", "sql_hash", "context_first", "processID"} {
+		if _, ok := doc[name]; !ok {
+			t.Errorf("field %s is missing", name)
+		}
+	}
+	if doc["duration"] != int64(15) || doc["@timestamp"] != "2024-01-02T03:04:05.000001Z" {
+		t.Errorf("duration %v, @timestamp %v", doc["duration"], doc["@timestamp"])
+	}
+}